@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	tb "github.com/xplshn/tinybox/pkg"
+)
+
+type counter struct {
+	count int
+}
+
+func (c *counter) Render() tb.Node {
+	color := 10
+	if c.count < 0 {
+		color = 9
+	}
+	return tb.VStack{
+		tb.BoxNode{
+			Title: "counter",
+			Style: tb.Style{Fg: 14},
+			Child: tb.Text{
+				Content: fmt.Sprintf("%d", c.count),
+				Style:   tb.Style{Fg: color, Bold: true},
+				Align:   tb.AlignCenter,
+			},
+		},
+		tb.HStack{
+			tb.Text{Content: "+ / up: increment", Style: tb.Style{Fg: 8}},
+			tb.Text{Content: "- / down: decrement", Style: tb.Style{Fg: 8}},
+			tb.Text{Content: "q: quit", Style: tb.Style{Fg: 8}, Align: tb.AlignRight},
+		},
+	}
+}
+
+func main() {
+	if err := tb.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer tb.Close()
+
+	c := &counter{}
+	rc := &tb.Reconciler{Root: c}
+	tb.Clear()
+	for {
+		w, _ := tb.Size()
+		rc.Update(tb.Rect{X: 2, Y: 1, W: w - 4, H: 4})
+		tb.Present()
+
+		evt, err := tb.PollEvent()
+		if err != nil || evt.Type != tb.EventKey {
+			if evt.Type == tb.EventResize {
+				tb.Clear()
+			}
+			continue
+		}
+		switch {
+		case evt.Key == tb.KeyCtrlC || evt.Ch == 'q':
+			return
+		case evt.Key == tb.KeyArrowUp || evt.Ch == '+':
+			c.count++
+		case evt.Key == tb.KeyArrowDown || evt.Ch == '-':
+			c.count--
+		}
+	}
+}
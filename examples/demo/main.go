@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -51,7 +52,7 @@ func loop(m *model) {
 
 		evt, err := tb.PollEventTimeout(200 * time.Millisecond)
 		if err != nil {
-			if err.Error() == "timeout" {
+			if errors.Is(err, tb.ErrTimeout) {
 				m.tick++
 				m.spinnerIx++
 				continue
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -165,17 +166,7 @@ func drawMemoryUsage(info *SystemInfo, x, y int) {
 	tb.PrintAt(x+2, y+3, fmt.Sprintf("Used: %s (%.1f%%)", formatBytes(memUsed), memPercent))
 	tb.PrintAt(x+2, y+4, fmt.Sprintf("Total: %s", formatBytes(info.MemoryTotal)))
 
-	barWidth := 25
-	usedWidth := int(float64(barWidth) * memPercent / 100.0)
-
-	tb.SetColor(2, 0)
-	for i := 0; i < usedWidth; i++ {
-		tb.PrintAt(x+2+i, y+5, "█")
-	}
-	tb.SetColor(8, 0)
-	for i := usedWidth; i < barWidth; i++ {
-		tb.PrintAt(x+2+i, y+5, "░")
-	}
+	tb.Gauge{Max: 100, Value: memPercent}.Draw(tb.Rect{X: x + 2, Y: y + 5, W: 31, H: 1})
 }
 
 func drawDiskUsage(info *SystemInfo, x, y int) {
@@ -267,7 +258,7 @@ func main() {
 		tb.Present()
 
 		event, err := tb.PollEventTimeout(time.Second)
-		if err != nil && err.Error() == "timeout" {
+		if errors.Is(err, tb.ErrTimeout) {
 			info.CurrentTime = time.Now().Format("2006-01-02 15:04:05")
 			status = "Clock updated"
 			continue
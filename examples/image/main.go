@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"os"
+
+	tb "github.com/xplshn/tinybox/pkg"
+)
+
+func main() {
+	img := load()
+
+	if err := tb.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer tb.Close()
+
+	for {
+		w, h := tb.Size()
+		tb.Clear()
+		tb.DrawImageBlocks(0, 0, w, h-1, img)
+		tb.SetColor(8, 0)
+		tb.PrintAt(0, h-1, "q to quit")
+		tb.Present()
+
+		evt, err := tb.PollEvent()
+		if err != nil {
+			continue
+		}
+		if evt.Type == tb.EventKey && (evt.Key == tb.KeyCtrlC || evt.Ch == 'q') {
+			return
+		}
+	}
+}
+
+// load decodes the PNG or JPEG named on the command line, or draws a color
+// wheel when there isn't one.
+func load() image.Image {
+	if len(os.Args) > 1 {
+		f, err := os.Open(os.Args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		img, _, err := image.Decode(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return img
+	}
+
+	const size = 128
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x-size/2), float64(y-size/2)
+			dist := math.Hypot(dx, dy) / (size / 2)
+			if dist > 1 {
+				continue
+			}
+			hue := (math.Atan2(dy, dx) + math.Pi) / (2 * math.Pi)
+			r, g, b := hsv(hue, dist)
+			img.Set(x, y, color.RGBA{r, g, b, 255})
+		}
+	}
+	return img
+}
+
+func hsv(h, s float64) (r, g, b uint8) {
+	i := int(h * 6)
+	f := h*6 - float64(i)
+	p, q, t := 1-s, 1-s*f, 1-s*(1-f)
+	var rf, gf, bf float64
+	switch i % 6 {
+	case 0:
+		rf, gf, bf = 1, t, p
+	case 1:
+		rf, gf, bf = q, 1, p
+	case 2:
+		rf, gf, bf = p, 1, t
+	case 3:
+		rf, gf, bf = p, q, 1
+	case 4:
+		rf, gf, bf = t, p, 1
+	default:
+		rf, gf, bf = 1, p, q
+	}
+	return uint8(rf * 255), uint8(gf * 255), uint8(bf * 255)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tb "github.com/xplshn/tinybox/pkg"
+)
+
+func main() {
+	if err := tb.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer tb.Close()
+
+	left, right := &tb.Viewport{}, &tb.Viewport{}
+	layout(left, right)
+
+	tb.Clear()
+	leftN, rightN := 0, 0
+	for {
+		tb.DrawTextLeft(0, "two viewports; q to quit", 14, 0)
+		drawFrame(left)
+		drawFrame(right)
+
+		tb.SetColor(10, 0)
+		push(left, fmt.Sprintf("left line %d", leftN))
+		leftN++
+		if leftN%3 == 0 {
+			tb.SetColor(12, 0)
+			push(right, fmt.Sprintf("right line %d", rightN))
+			rightN++
+		}
+		tb.Present()
+
+		evt, err := tb.PollEventTimeout(150 * time.Millisecond)
+		if err != nil {
+			continue
+		}
+		switch evt.Type {
+		case tb.EventKey:
+			if evt.Key == tb.KeyCtrlC || evt.Key == tb.KeyEscape || evt.Ch == 'q' {
+				return
+			}
+		case tb.EventResize:
+			layout(left, right)
+			tb.Clear()
+		}
+	}
+}
+
+func layout(left, right *tb.Viewport) {
+	w, h := tb.Size()
+	_, body := tb.SplitTop(tb.Rect{X: 0, Y: 0, W: w, H: h}, 1)
+	l, r := tb.SplitHorizontal(body, 0.5)
+	left.Rect, right.Rect = l, r
+}
+
+func drawFrame(v *tb.Viewport) {
+	w, h := v.Size()
+	tb.SetColor(8, 0)
+	v.Box(0, 0, w, h)
+}
+
+// push scrolls the inside of the frame up one row and writes text at the bottom.
+func push(v *tb.Viewport, text string) {
+	w, h := v.Size()
+	inner := tb.Viewport{Rect: tb.Rect{X: v.Rect.X + 1, Y: v.Rect.Y + 1, W: w - 2, H: h - 2}}
+	inner.Scroll(-1)
+	inner.PrintAt(0, h-3, text)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	tb "github.com/xplshn/tinybox/pkg"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: tail FILE")
+		os.Exit(2)
+	}
+	f, err := os.Open(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := tb.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer tb.Close()
+
+	w, h := tb.Size()
+	tb.Clear()
+	tb.SetColor(14, 0)
+	tb.Box(0, 0, w, h)
+	tb.PrintAt(2, 0, " "+os.Args[1]+" ")
+	tb.SetColor(7, 0)
+
+	pane := &tb.CellWriter{Rect: tb.Rect{X: 1, Y: 1, W: w - 2, H: h - 2}}
+	for {
+		if _, err := io.Copy(pane, f); err != nil {
+			log.Fatal(err)
+		}
+		tb.Present()
+
+		evt, err := tb.PollEventTimeout(250 * time.Millisecond)
+		if err != nil {
+			continue
+		}
+		if evt.Type == tb.EventKey && (evt.Key == tb.KeyCtrlC || evt.Ch == 'q') {
+			return
+		}
+	}
+}
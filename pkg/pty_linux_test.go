@@ -0,0 +1,293 @@
+//go:build linux
+
+package tb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPTY creates a w x h pseudo terminal for the test and returns its
+// master side and the path to pass to InitTTY.
+func openPTY(t *testing.T, w, h int) (*os.File, string) {
+	t.Helper()
+	// Non-blocking so the runtime poller honors read deadlines.
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	var n uint32
+	var unlock int32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, m.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); e != 0 {
+		t.Fatal(e)
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, m.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		t.Fatal(e)
+	}
+	ws := winsize{Row: uint16(h), Col: uint16(w)}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, m.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); e != 0 {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() {
+		Close()
+		term = Terminal{}
+	})
+	return m, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// readPTY returns what has been written to the terminal since the last call.
+func readPTY(t *testing.T, m *os.File) string {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, 4096)
+	for {
+		m.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, err := m.Read(buf)
+		out = append(out, buf[:n]...)
+		// EIO means the slave side was closed and everything has been read.
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.EIO) {
+			return string(out)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInitCloseCycle(t *testing.T) {
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := GetTerminalSize(); w != 20 || h != 5 {
+		t.Errorf("size = %dx%d, want 20x5", w, h)
+	}
+	if err := Init(); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Errorf("second Init = %v, want ErrAlreadyInitialized", err)
+	}
+	sizeCh := SizeChanged()
+	EnableMouse()
+	PushOffset(2, 1)
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := readPTY(t, m); !contains(out, AlternateScreen, DisableMouseMode, NormalScreen) {
+		t.Errorf("first session wrote %q", out)
+	}
+
+	if err := InitTTY(path); err != nil {
+		t.Fatalf("Init after Close: %v", err)
+	}
+	if term.mouseEnabled || term.offsetX != 0 || len(term.offsetStack) != 0 {
+		t.Errorf("state leaked into the second session: mouse %v offset %d", term.mouseEnabled, term.offsetX)
+	}
+	if SizeChanged() != sizeCh {
+		t.Error("SizeChanged channel replaced by the second Init")
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := readPTY(t, m); !contains(out, AlternateScreen, NormalScreen) || contains(out, DisableMouseMode) {
+		t.Errorf("second session wrote %q", out)
+	}
+}
+
+// suspend runs Suspend with SIGTSTP caught so the test process isn't
+// stopped, and waits for the signal.
+func suspend(t *testing.T) {
+	t.Helper()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTSTP)
+	defer signal.Stop(ch)
+	Suspend()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("Suspend didn't raise SIGTSTP")
+	}
+}
+
+func TestSuspendResumeCursorStyle(t *testing.T) {
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	SetCursorStyle(CursorLine)
+	readPTY(t, m)
+
+	suspend(t)
+	if out := readPTY(t, m); !contains(out, ShowCursor, DefaultCursor, NormalScreen) {
+		t.Errorf("Suspend wrote %q, want the cursor shown in its default style", out)
+	}
+	Resume()
+	style := "\x1b[" + strconv.Itoa(CursorLine) + " q"
+	if out := readPTY(t, m); !contains(out, AlternateScreen, HideCursor, style) {
+		t.Errorf("Resume wrote %q, want the cursor hidden again in style %q", out, style)
+	}
+}
+
+func TestSuspendResumeConsistent(t *testing.T) {
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	PrintAt(0, 1, "kept")
+	Present()
+	readPTY(t, m)
+	canonical := func() bool {
+		tio, err := getTermios(inFd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tio.Lflag&ICANON != 0
+	}
+
+	suspend(t)
+	if IsRawMode() || !canonical() {
+		t.Error("terminal still raw while suspended")
+	}
+	readPTY(t, m)
+	Suspend()
+	if out := readPTY(t, m); out != "" {
+		t.Errorf("second Suspend wrote %q", out)
+	}
+
+	flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(inFd), F_GETFL, 0)
+	syscall.Syscall(syscall.SYS_FCNTL, uintptr(inFd), F_SETFL, flags|O_NONBLOCK)
+	Resume()
+	if !IsRawMode() || canonical() {
+		t.Error("raw mode not back after Resume")
+	}
+	if flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(inFd), F_GETFL, 0); flags&O_NONBLOCK != 0 {
+		t.Error("input left non-blocking after Resume")
+	}
+	readPTY(t, m)
+	Resume()
+	if out := readPTY(t, m); out != "" {
+		t.Errorf("second Resume wrote %q", out)
+	}
+
+	Present()
+	if out := readPTY(t, m); !contains(out, "kept") {
+		t.Errorf("Present after Resume wrote %q, want the buffer repainted", out)
+	}
+	if rowText(1)[:4] != "kept" {
+		t.Errorf("row 1 = %q after Resume", rowText(1))
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	if err := Close(); err != nil {
+		t.Errorf("Close before Init = %v", err)
+	}
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	readPTY(t, m)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Close()
+		}()
+	}
+	wg.Wait()
+	if out := readPTY(t, m); strings.Count(out, NormalScreen) != 1 {
+		t.Errorf("eight concurrent Closes wrote %q, want one teardown", out)
+	}
+	if err := Close(); err != nil {
+		t.Errorf("Close after Close = %v", err)
+	}
+}
+
+func TestShellRestoresModes(t *testing.T) {
+	if _, err := exec.LookPath("stty"); err != nil {
+		t.Skip("no stty")
+	}
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	EnableMouse()
+	EnableBracketedPaste()
+	SetCursorStyle(CursorLine)
+	readPTY(t, m)
+
+	// stty reports the mode the child was handed.
+	if err := Shell(exec.Command("stty", "-a")); err != nil {
+		t.Fatal(err)
+	}
+	out := readPTY(t, m)
+	before, after, ok := strings.Cut(out, "speed")
+	if !ok {
+		t.Fatalf("no stty output in %q", out)
+	}
+	if !contains(before, DisableMouseMode, DisableBracketPaste, ShowCursor, DefaultCursor, NormalScreen) {
+		t.Errorf("before the child Shell wrote %q", before)
+	}
+	if strings.Contains(after, "-icanon") || !strings.Contains(after, "icanon") {
+		t.Error("child didn't run in cooked mode")
+	}
+	style := "\x1b[" + strconv.Itoa(CursorLine) + " q"
+	if !contains(after, AlternateScreen, HideCursor, style, EnableMouseMode, EnableBracketPaste) {
+		t.Errorf("after the child Shell wrote %q", after)
+	}
+	if !IsRawMode() || !term.mouseEnabled || !term.pasteEnabled || !AltScreenActive() {
+		t.Error("modes not restored after Shell")
+	}
+}
+
+func TestCursorColor(t *testing.T) {
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	SetMux(MuxNone)
+	readPTY(t, m)
+
+	SetCursorColor(255, 128, 0)
+	if out := readPTY(t, m); out != "\x1b]12;rgb:ff/80/00\a" {
+		t.Errorf("SetCursorColor wrote %q, want OSC 12", out)
+	}
+	Close()
+	if out := readPTY(t, m); !contains(out, "\x1b]112\a") {
+		t.Errorf("Close wrote %q, want OSC 112 to reset the cursor color", out)
+	}
+}
+
+func TestScrollRegionSuspendResume(t *testing.T) {
+	m, path := openPTY(t, 20, 5)
+	if err := InitTTY(path); err != nil {
+		t.Fatal(err)
+	}
+	SetScrollRegion(1, 3)
+	readPTY(t, m)
+
+	suspend(t)
+	if out := readPTY(t, m); !contains(out, ResetScrollMargins) {
+		t.Errorf("Suspend wrote %q, want the scroll region reset", out)
+	}
+	Resume()
+	if out := readPTY(t, m); !contains(out, "\x1b[2;4r") {
+		t.Errorf("Resume wrote %q, want the scroll region back", out)
+	}
+	Close()
+	if out := readPTY(t, m); !contains(out, ResetScrollMargins) {
+		t.Errorf("Close wrote %q, want the scroll region reset", out)
+	}
+}
@@ -25,12 +25,26 @@ SOFTWARE. */
 package tb
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"io"
+	"math"
 	"os"
+	"os/exec"
 	"os/signal"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 	"unsafe"
 )
@@ -49,11 +63,24 @@ const (
 	AlternateScreen = ESC + "[?1049h"
 	NormalScreen    = ESC + "[?1049l"
 	QueryCursorPos  = ESC + "[6n"
+	DefaultCursor   = ESC + "[0 q"
+
+	SetCursorColorRGB = ESC + "]12;rgb:%02x/%02x/%02x" + BEL
+	ResetCursorColor  = ESC + "]112" + BEL
+
+	SetScrollMargins   = ESC + "[%d;%dr"
+	ResetScrollMargins = ESC + "[r"
 
 	EnableMouseMode     = ESC + "[?1000h" + ESC + "[?1002h" + ESC + "[?1015h" + ESC + "[?1006h"
 	DisableMouseMode    = ESC + "[?1000l" + ESC + "[?1002l" + ESC + "[?1015l" + ESC + "[?1006l"
 	EnableBracketPaste  = ESC + "[?2004h"
 	DisableBracketPaste = ESC + "[?2004l"
+	PasteStart          = ESC + "[200~"
+	PasteEnd            = ESC + "[201~"
+	BeginSyncUpdate     = ESC + "[?2026h"
+	EndSyncUpdate       = ESC + "[?2026l"
+	EnableFocusMode     = ESC + "[?1004h"
+	DisableFocusMode    = ESC + "[?1004l"
 
 	ResetColor = ESC + "[0m"
 	SetFgColor = ESC + "[38;5;%dm"
@@ -63,10 +90,15 @@ const (
 	SetItalic      = ESC + "[3m"
 	SetUnderline   = ESC + "[4m"
 	SetReverse     = ESC + "[7m"
+	SetStrike      = ESC + "[9m"
 	UnsetBold      = ESC + "[22m"
 	UnsetItalic    = ESC + "[23m"
 	UnsetUnderline = ESC + "[24m"
 	UnsetReverse   = ESC + "[27m"
+	UnsetStrike    = ESC + "[29m"
+
+	SetUnderlineColor256 = ESC + "[58;5;%dm"
+	ResetUnderlineColor  = ESC + "[59m"
 
 	BoxTopLeft     = '┌'
 	BoxTopRight    = '┐'
@@ -75,6 +107,11 @@ const (
 	BoxHorizontal  = '─'
 	BoxVertical    = '│'
 
+	RoundTopLeft     = '╭'
+	RoundTopRight    = '╮'
+	RoundBottomLeft  = '╰'
+	RoundBottomRight = '╯'
+
 	CursorBlock     = 1
 	CursorLine      = 3
 	CursorUnderline = 5
@@ -89,7 +126,38 @@ var (
 	seqUnsetUnderline = []byte(UnsetUnderline)
 	seqSetReverse     = []byte(SetReverse)
 	seqUnsetReverse   = []byte(UnsetReverse)
+	seqSetStrike      = []byte(SetStrike)
+	seqUnsetStrike    = []byte(UnsetStrike)
+	seqResetUnderCol  = []byte(ResetUnderlineColor)
+	seqClearToEOL     = []byte(ClearToEOL)
+	seqClearScreen    = []byte(ClearScreen)
+	seqHome           = []byte(ESC + "[H")
+	seqHideCursor     = []byte(HideCursor)
+	seqShowCursor     = []byte(ShowCursor)
 	resetColorSeq     = []byte(ResetColor)
+	seqBeginSync      = []byte(BeginSyncUpdate)
+	seqEndSync        = []byte(EndSyncUpdate)
+	seqPasteStart     = []byte(PasteStart)
+	seqPasteEnd       = []byte(PasteEnd)
+)
+
+type boxChars struct {
+	tl, tr, bl, br, h, v rune
+}
+
+var (
+	unicodeBox = boxChars{BoxTopLeft, BoxTopRight, BoxBottomLeft, BoxBottomRight, BoxHorizontal, BoxVertical}
+	asciiBox   = boxChars{'+', '+', '+', '+', '-', '|'}
+	roundBox   = boxChars{RoundTopLeft, RoundTopRight, RoundBottomLeft, RoundBottomRight, BoxHorizontal, BoxVertical}
+	asciiRound = boxChars{'.', '.', '\'', '\'', '-', '|'}
+
+	ansiColors = [16][3]int{
+		{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+		{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+		{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+		{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+	}
+	cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
 )
 
 type termios = syscall.Termios
@@ -99,33 +167,156 @@ type winsize struct {
 }
 
 type Cell struct {
-	Ch     rune
+	Ch         rune
+	Fg         int
+	Bg         int
+	Bold       bool
+	Italic     bool
+	Under      bool
+	UnderStyle UnderlineStyle
+	UnderColor int // -1 follows the foreground
+	Rev        bool
+	Strike     bool
+	Seq        string // whole grapheme cluster when it is more than Ch
+	Cont       bool   // covered by a wide cluster to the left
+	Dirty      bool
+}
+
+type Style struct {
 	Fg     int
 	Bg     int
 	Bold   bool
 	Italic bool
 	Under  bool
 	Rev    bool
-	Dirty  bool
+	Strike bool
 }
 
+type Align int
+
+const (
+	AlignLeft Align = iota
+	AlignCenter
+	AlignRight
+)
+
+type UnderlineStyle int
+
+const (
+	UnderlineSingle UnderlineStyle = iota
+	UnderlineDouble
+	UnderlineCurly
+	UnderlineDotted
+	UnderlineDashed
+)
+
 type Buffer struct {
 	Width  int
 	Height int
 	Cells  [][]Cell
+
+	// dirtyRows marks the rows holding at least one Dirty cell so Present
+	// can skip the rest without looking at their cells.
+	dirtyRows []bool
+}
+
+type Rect struct {
+	X, Y, W, H int
+}
+
+type offset struct {
+	dx, dy int
 }
 
 type Event struct {
-	Type   EventType
-	Key    Key
-	Ch     rune
-	X      int
-	Y      int
-	Button MouseButton
-	Mod    KeyMod
-	Press  bool
+	Type    EventType
+	Key     Key
+	Ch      rune
+	X       int
+	Y       int
+	Button  MouseButton
+	Mod     KeyMod
+	Press   bool
+	Focused bool
+	Raw     []byte
+	Repeat  int    // identical key events folded into this one
+	Text    string // pasted text for EventPaste
+	Timer   int    // timer id for EventTimer
+	Clicks  int    // 1 for a click, 2 for a double click, 3 for a triple...
+}
+
+type Stats struct {
+	CellsConsidered int
+	CellsWritten    int
+	BytesWritten    int
+	CursorMoves     int
+}
+
+// Capabilities is what ProbeCapabilities learned from the terminal. Fields
+// stay at their zero value when the terminal didn't answer.
+type Capabilities struct {
+	DeviceAttrs    []int  // DA1 parameters
+	SyncOutput     bool   // mode 2026
+	BracketedPaste bool   // mode 2004
+	FocusEvents    bool   // mode 1004
+	Foreground     string // OSC 10 reply, "rgb:rrrr/gggg/bbbb"
+	Background     string // OSC 11 reply
 }
 
+type KeyRepeatMode int
+
+const (
+	KeyRepeatAll KeyRepeatMode = iota
+	KeyRepeatCoalesce
+)
+
+const (
+	eraseMinRun  = 4
+	repMinRun    = 6
+	repeatWindow = 5 * time.Millisecond
+	clickWindow  = 400 * time.Millisecond
+	pasteBurst   = 8
+)
+
+type FlushMode int
+
+const (
+	AutoFlush FlushMode = iota
+	ManualFlush
+)
+
+type Mux int
+
+const (
+	MuxNone Mux = iota
+	MuxTmux
+	MuxScreen
+)
+
+type Ramp int
+
+const (
+	RampHeat Ramp = iota // blue, green, yellow, red
+	RampViridis
+	RampGray
+	RampJet
+)
+
+type RenderMode int
+
+const (
+	RenderIncremental RenderMode = iota
+	RenderFull
+)
+
+type PromptState int
+
+const (
+	PromptPending PromptState = iota
+	PromptConfirmed
+	PromptCancelled
+)
+
 type EventType int
 
 const (
@@ -133,6 +324,9 @@ const (
 	EventMouse
 	EventResize
 	EventPaste
+	EventFocus
+	EventUnknown
+	EventTimer
 )
 
 type Key int
@@ -172,6 +366,13 @@ const (
 	KeyDelete
 )
 
+type LineDrawingMode int
+
+const (
+	LineDrawingUnicode LineDrawingMode = iota
+	LineDrawingASCII
+)
+
 type KeyMod int
 
 const (
@@ -191,34 +392,136 @@ const (
 )
 
 type Terminal struct {
-	origTermios   termios
-	buffer        Buffer
-	backBuffer    Buffer
-	savedBuffer   [][]Cell
-	width         int
-	height        int
-	initialized   bool
-	isRaw         bool
-	mouseEnabled  bool
-	pasteEnabled  bool
-	eventQueue    []Event
-	currentFg     int
-	currentBg     int
-	currentBold   bool
-	currentItalic bool
-	currentUnder  bool
-	currentRev    bool
-	cursorX       int
-	cursorY       int
-	cursorVisible bool
-	cursorStyle   int
-	escDelay      int
-	sigwinchCh    chan os.Signal
-	sigcontCh     chan os.Signal
+	origTermios         termios
+	buffer              Buffer
+	backBuffer          Buffer
+	savedBuffer         [][]Cell
+	width               int
+	height              int
+	initialized         bool
+	isRaw               bool
+	altScreen           bool
+	resumeAlt           bool
+	normalUsed          bool
+	normalTop           int
+	normalBottom        int
+	startRow            int
+	startCol            int
+	startKnown          bool
+	mouseEnabled        bool
+	pasteEnabled        bool
+	focusEnabled        bool
+	eventQueue          []Event
+	pendingInput        []byte // held back by PollEventNow mid-sequence
+	pendingSince        time.Time
+	inputNoWait         bool
+	currentFg           int
+	currentBg           int
+	currentBold         bool
+	currentItalic       bool
+	currentUnder        bool
+	currentRev          bool
+	currentStrike       bool
+	currentUStyle       UnderlineStyle
+	currentUColor       int
+	extUnderline        bool
+	trueColor           bool
+	lineMode            LineDrawingMode
+	boxCustom           bool
+	boxChars            boxChars
+	cursorX             int
+	cursorY             int
+	cursorVisible       bool
+	altCursorVisible    bool // cursorVisible to restore on EnterAltScreen
+	cursorStyle         int
+	cursorStyled        bool
+	cursorColored       bool
+	scrollRegion        bool
+	scrollTop           int
+	scrollBottom        int
+	mux                 Mux
+	muxSet              bool
+	suspended           bool
+	softCursor          bool
+	softX               int
+	softY               int
+	softStyle           int
+	selection           bool
+	selStart, selEnd    [2]int
+	selBg               int
+	selBgSet            bool
+	selSaved            []Cell
+	blinkInterval       time.Duration
+	blinkStart          time.Time
+	lastClick           Event
+	lastClickAt         time.Time
+	clickHeld           bool
+	lastResume          time.Time
+	escDelay            int
+	clipStack           []Rect
+	offsetStack         []offset
+	colorStack          []Style
+	attrStack           []Style
+	offsetX             int
+	offsetY             int
+	oscSaved            map[string]string
+	stats               Stats
+	flushMode           FlushMode
+	renderMode          RenderMode
+	repeatMode          KeyRepeatMode
+	pending             []byte
+	maybeBlank          bool
+	syncOutput          bool
+	syncProbed          bool
+	syncSupported       bool
+	repOutput           bool
+	repProbed           bool
+	repSupported        bool
+	pasteProbed         bool
+	pasteSupported      bool
+	pasteHeuristic      bool
+	caps                Capabilities
+	capsProbed          bool
+	recorder            io.Writer
+	recordLast          time.Time
+	replay              []inputRecord
+	replayLast          time.Time
+	replayFast          bool
+	readBuf             []byte
+	showDuringRender    bool
+	outBuf              []byte
+	strictBounds        bool
+	debugW              io.Writer
+	eventFilter         func(Event) (Event, bool)
+	timers              []timer
+	nextTimerID         int
+	minWidth, minHeight int
+	tooSmall            bool
+	tooSmallBuf         Buffer // scratch buffer for the notice, kept between frames
+	sigwinchCh          chan os.Signal
+	sigcontCh           chan os.Signal
+	sizeCh              chan struct{}
+	exitSigCh           chan os.Signal
 }
 
 var term Terminal
 
+// jobMu serialises Suspend, Resume and Close, which can be reached from the
+// signal goroutines as well as the main loop.
+var jobMu sync.Mutex
+
+var (
+	inFd    = int(syscall.Stdin)
+	outFd   = int(syscall.Stdout)
+	ttyFile *os.File
+)
+
+var ErrAlreadyInitialized = errors.New("terminal already initialized")
+
+var ErrCanceled = errors.New("input canceled")
+
+var ErrTimeout = errors.New("timeout")
+
 func getTermios(fd int) (*termios, error) {
 	var t termios
 	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), TCGETS, uintptr(unsafe.Pointer(&t)))
@@ -237,7 +540,7 @@ func setTermios(fd int, t *termios) error {
 }
 
 func enableRawMode() error {
-	orig, err := getTermios(int(syscall.Stdin))
+	orig, err := getTermios(inFd)
 	if err != nil {
 		return err
 	}
@@ -249,84 +552,474 @@ func enableRawMode() error {
 	raw.Cflag |= CS8
 	raw.Cc[VMIN] = 1
 	raw.Cc[VTIME] = 0
-	return setTermios(int(syscall.Stdin), &raw)
+	return setTermios(inFd, &raw)
 }
 
 func disableRawMode() error {
-	return setTermios(int(syscall.Stdin), &term.origTermios)
+	return setTermios(inFd, &term.origTermios)
 }
 
 func queryTermSize() (int, int, error) {
-	writeString("\033[999;999H\033[6n")
-
-	var buf [32]byte
-	fd := int(syscall.Stdin)
-
-	fdSet := &syscall.FdSet{}
-	setFd(fdSet, fd)
-	tv := syscall.Timeval{Sec: 1, Usec: 0}
-
-	n, err := selectRead(fd, fdSet, &tv)
+	row, col, err := queryCursorReport("\033[999;999H\033[6n", time.Second)
 	if err != nil {
 		return 80, 24, err
 	}
-	if n <= 0 {
-		return 80, 24, fmt.Errorf("timeout")
-	}
+	return col, row, nil
+}
 
-	n, err = syscall.Read(syscall.Stdin, buf[:])
-	if err != nil || n < 6 {
-		return 80, 24, fmt.Errorf("failed to read terminal response")
+func parseCursorReport(seq []byte) (row, col int, ok bool) {
+	if len(seq) < 6 || seq[len(seq)-1] != 'R' {
+		return 0, 0, false
 	}
+	_, err := fmt.Sscanf(string(seq[2:]), "%d;%dR", &row, &col)
+	return row, col, err == nil
+}
 
-	response := string(buf[:n])
-	if len(response) >= 6 && response[0] == '\x1b' && response[1] == '[' {
-		var row, col int
-		if _, err := fmt.Sscanf(response[2:], "%d;%dR", &row, &col); err == nil {
-			return col, row, nil
+// queryCursorReport sends query and waits for the ESC[row;colR it provokes.
+// Keys typed in the meantime arrive mixed in with the reply; they're parsed
+// and queued instead of being thrown away.
+func queryCursorReport(query string, timeout time.Duration) (row, col int, err error) {
+	writeString(query)
+	found := false
+	claim := func(seq []byte) bool {
+		if found {
+			return false
+		}
+		row, col, found = parseCursorReport(seq)
+		return found
+	}
+	reply, err := readReply(timeout, func(b []byte) bool {
+		for i := bytes.IndexByte(b, 0x1b); i >= 0; {
+			if n := replyLength(b[i:]); n > 0 {
+				if _, _, ok := parseCursorReport(b[i : i+n]); ok {
+					return true
+				}
+			}
+			j := bytes.IndexByte(b[i+1:], 0x1b)
+			if j < 0 {
+				break
+			}
+			i += j + 1
+		}
+		return false
+	})
+	if rest := splitReplies(reply, claim); len(rest) > 0 {
+		term.eventQueue = append(term.eventQueue, parseEvents(rest)...)
+	}
+	if !found {
+		if err == nil {
+			err = fmt.Errorf("no cursor report")
 		}
+		return 0, 0, err
 	}
-	return 80, 24, nil
+	return row, col, nil
 }
 
 func getTermSize() (int, int, error) {
+	var ws winsize
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(outFd), TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if e == 0 && ws.Col > 0 && ws.Row > 0 {
+		return int(ws.Col), int(ws.Row), nil
+	}
 	cols, _ := strconv.Atoi(os.Getenv("COLUMNS"))
 	lines, _ := strconv.Atoi(os.Getenv("LINES"))
 	if cols > 0 && lines > 0 {
 		return cols, lines, nil
 	}
-	var ws winsize
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(syscall.Stdout), TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
-	if e == 0 {
-		return int(ws.Col), int(ws.Row), nil
-	}
 	return queryTermSize()
 }
 
-func handleSigwinch() {
-	for range term.sigwinchCh {
+// The signal handlers get their channel as an argument: Close replaces term
+// while they may still be draining it.
+func handleSigwinch(ch <-chan os.Signal) {
+	for range ch {
 		width, height, err := getTermSize()
-		if err == nil && (width != term.width || height != term.height) {
-			term.width = width
-			term.height = height
-			term.buffer = initBuffer(width, height)
-			term.backBuffer = initBuffer(width, height)
+		if err == nil {
+			resize(width, height)
+		}
+	}
+}
+
+// resize reallocates the buffers, keeping whatever of the old content still
+// fits, and announces the change. The whole screen is repainted on the next
+// Present since the terminal may have reflowed or cleared it.
+func resize(width, height int) {
+	if width == term.width && height == term.height {
+		return
+	}
+	old := term.buffer
+	term.width = width
+	term.height = height
+	term.buffer = initBuffer(width, height)
+	term.backBuffer = initBuffer(width, height)
+	for y := 0; y < min(height, len(old.Cells)); y++ {
+		copy(term.buffer.Cells[y], old.Cells[y])
+	}
+	Invalidate()
+
+	if len(term.eventQueue) < cap(term.eventQueue) {
+		term.eventQueue = append(term.eventQueue, Event{Type: EventResize})
+	}
+	select {
+	case term.sizeCh <- struct{}{}:
+	default:
+	}
+}
+
+// SetSize resizes the screen to what the caller says it is, for hosts that
+// learn the size from their own protocol rather than the tty. It behaves
+// like a SIGWINCH reporting width x height.
+func SetSize(width, height int) {
+	if width <= 0 || height <= 0 {
+		return
+	}
+	resize(width, height)
+}
 
-			if len(term.eventQueue) < cap(term.eventQueue) {
-				term.eventQueue = append(term.eventQueue, Event{Type: EventResize})
+// HandleSignals restores the terminal when one of the given signals (SIGINT
+// and SIGTERM by default) arrives. Close runs first, then onSignal is called
+// if set; otherwise the signal is re-raised with its default action so the
+// process dies the way it would have without tinybox.
+func HandleSignals(onSignal func(os.Signal), signals ...os.Signal) {
+	if !term.initialized || term.exitSigCh != nil {
+		return
+	}
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	term.exitSigCh = ch
+	signal.Notify(ch, signals...)
+	go func() {
+		for sig := range ch {
+			Close()
+			if onSignal != nil {
+				onSignal(sig)
+				continue
+			}
+			signal.Reset(sig)
+			if s, ok := sig.(syscall.Signal); ok {
+				syscall.Kill(syscall.Getpid(), s)
 			}
 		}
-	}
+	}()
 }
 
-func handleSigcont() {
-	for range term.sigcontCh {
+func handleSigcont(ch <-chan os.Signal) {
+	for range ch {
 		Resume()
 	}
 }
 
+func readReply(timeout time.Duration, done func([]byte) bool) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	var reply []byte
+	var buf [64]byte
+	for !done(reply) {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return reply, ErrTimeout
+		}
+		n, err := readInput(buf[:], left)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return reply, err
+		}
+		reply = append(reply, buf[:n]...)
+	}
+	return reply, nil
+}
+
+// queryPrivateMode asks the terminal for the state of a DEC private mode
+// (DECRQM). The reply value is 0 when the mode isn't recognized, 1/2 when it
+// is set/reset and 3/4 when it is permanently set/reset.
+func queryPrivateMode(mode int) (int, bool) {
+	writeString(fmt.Sprintf(ESC+"[?%d$p", mode))
+	reply, err := readReply(200*time.Millisecond, func(b []byte) bool {
+		return len(b) > 0 && b[len(b)-1] == 'y'
+	})
+	if err != nil {
+		return 0, false
+	}
+	i := strings.Index(string(reply), ESC+"[?")
+	if i < 0 {
+		return 0, false
+	}
+	var got, value int
+	if _, err := fmt.Sscanf(string(reply[i+3:]), "%d;%d$y", &got, &value); err != nil || got != mode {
+		return 0, false
+	}
+	return value, true
+}
+
+func oscTerminated(reply []byte) bool {
+	n := len(reply)
+	return n > 0 && (reply[n-1] == 7 || (n > 1 && reply[n-2] == 27 && reply[n-1] == '\\'))
+}
+
+func queryOSCColor(prefix string) (string, bool) {
+	writeString(wrapOSC(ESC + "]" + prefix + ";?" + BEL))
+	reply, err := readReply(200*time.Millisecond, oscTerminated)
+	if err != nil {
+		return "", false
+	}
+	return parseOSCColorReply(reply)
+}
+
+// parseOSCColorReply pulls the "rgb:..." spec out of a reply such as
+// ESC ] 11 ; rgb:1e1e/1e1e/2e2e BEL.
+func parseOSCColorReply(reply []byte) (string, bool) {
+	s := string(reply)
+	start := strings.Index(s, "rgb:")
+	if start < 0 {
+		return "", false
+	}
+	end := strings.IndexAny(s[start:], "\x07\x1b")
+	if end < 0 {
+		return "", false
+	}
+	return s[start : start+end], true
+}
+
+func parseRGBSpec(spec string) (r, g, b int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(spec, "rgb:"), "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	var rgb [3]int
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 4 {
+			return 0, 0, 0, false
+		}
+		v, err := strconv.ParseUint(part, 16, 16)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		maxVal := uint64(1)<<(4*len(part)) - 1
+		rgb[i] = int(v * 255 / maxVal)
+	}
+	return rgb[0], rgb[1], rgb[2], true
+}
+
+// replyLength returns the length of the CSI or OSC sequence at the start of
+// b, or 0 if b doesn't start with a complete one.
+func replyLength(b []byte) int {
+	if len(b) < 2 || b[0] != 0x1b {
+		return 0
+	}
+	switch b[1] {
+	case '[':
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']':
+		for i := 2; i < len(b); i++ {
+			if b[i] == 0x07 {
+				return i + 1
+			}
+			if b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	}
+	return 0
+}
+
+// splitReplies hands every sequence in data to handle and returns the bytes
+// that handle didn't claim, such as keys typed while a query was in flight.
+func splitReplies(data []byte, handle func([]byte) bool) []byte {
+	var rest []byte
+	for i := 0; i < len(data); {
+		if n := replyLength(data[i:]); n > 0 && handle(data[i:i+n]) {
+			i += n
+			continue
+		}
+		rest = append(rest, data[i])
+		i++
+	}
+	return rest
+}
+
+func hasDeviceAttrs(b []byte) bool {
+	i := bytes.LastIndex(b, []byte(ESC+"[?"))
+	if i < 0 {
+		return false
+	}
+	n := replyLength(b[i:])
+	return n > 0 && b[i+n-1] == 'c'
+}
+
+// ProbeCapabilities sends all of its queries at once and sorts the replies
+// out as they arrive, so startup pays for a single round trip rather than
+// one per query. DA1 goes last: practically every terminal answers it and
+// replies come back in order, so it ends the wait well before budget runs
+// out. The result is cached for the rest of the session.
+func ProbeCapabilities(budget time.Duration) Capabilities {
+	if !term.initialized || term.capsProbed {
+		return term.caps
+	}
+	modes := []int{2026, 2004, 1004}
+	var q strings.Builder
+	for _, m := range modes {
+		fmt.Fprintf(&q, ESC+"[?%d$p", m)
+	}
+	q.WriteString(wrapOSC(ESC+"]10;?"+BEL) + wrapOSC(ESC+"]11;?"+BEL) + ESC + "[c")
+	writeString(q.String())
+
+	reply, _ := readReply(budget, hasDeviceAttrs)
+
+	var caps Capabilities
+	values := make(map[int]int)
+	rest := splitReplies(reply, func(seq []byte) bool {
+		s := string(seq)
+		switch {
+		case strings.HasPrefix(s, ESC+"[?") && strings.HasSuffix(s, "$y"):
+			var mode, value int
+			if _, err := fmt.Sscanf(s[3:], "%d;%d$y", &mode, &value); err != nil {
+				return false
+			}
+			values[mode] = value
+		case strings.HasPrefix(s, ESC+"[?") && strings.HasSuffix(s, "c"):
+			for _, f := range strings.Split(s[3:len(s)-1], ";") {
+				if n, err := strconv.Atoi(f); err == nil {
+					caps.DeviceAttrs = append(caps.DeviceAttrs, n)
+				}
+			}
+		case strings.HasPrefix(s, ESC+"]10;"), strings.HasPrefix(s, ESC+"]11;"):
+			spec := strings.TrimRight(s[5:], "\x07\x1b\\")
+			if s[3] == '0' {
+				caps.Foreground = spec
+			} else {
+				caps.Background = spec
+			}
+		default:
+			return false
+		}
+		return true
+	})
+	if len(rest) > 0 {
+		term.eventQueue = append(term.eventQueue, parseEvents(rest)...)
+	}
+
+	set := func(mode int) bool {
+		v, ok := values[mode]
+		return ok && v != 0 && v != 4
+	}
+	caps.SyncOutput = set(2026)
+	caps.BracketedPaste = set(2004)
+	caps.FocusEvents = set(1004)
+
+	// A terminal that answered DA1 but not DECRQM simply doesn't implement
+	// DECRQM; SetSyncMode keeps assuming sync output works in that case.
+	_, answered := values[2026]
+	term.syncSupported = !answered || caps.SyncOutput
+	term.syncProbed = true
+	term.pasteSupported = caps.BracketedPaste
+	term.pasteProbed = true
+	term.caps = caps
+	term.capsProbed = true
+	return caps
+}
+
+func setOSCColor(prefix string, r, g, b int) {
+	if term.oscSaved == nil {
+		term.oscSaved = make(map[string]string)
+	}
+	if _, seen := term.oscSaved[prefix]; !seen {
+		spec, _ := queryOSCColor(prefix)
+		term.oscSaved[prefix] = spec
+	}
+	writeString(wrapOSC(fmt.Sprintf(ESC+"]%s;rgb:%02x/%02x/%02x"+BEL, prefix, r&0xff, g&0xff, b&0xff)))
+}
+
+func restoreOSCColors() {
+	for prefix, spec := range term.oscSaved {
+		if spec != "" {
+			writeString(wrapOSC(ESC + "]" + prefix + ";" + spec + BEL))
+		}
+	}
+	term.oscSaved = nil
+}
+
+// DetectMux reports the terminal multiplexer output goes through, going by
+// $TMUX and $STY. $TERM alone can't tell: tmux sets it to screen too, and
+// it survives ssh to hosts where no multiplexer is running.
+func DetectMux() Mux {
+	switch {
+	case os.Getenv("TMUX") != "":
+		return MuxTmux
+	case os.Getenv("STY") != "":
+		return MuxScreen
+	}
+	return MuxNone
+}
+
+// SetMux overrides the detected multiplexer; MuxNone turns passthrough
+// wrapping off.
+func SetMux(m Mux) {
+	term.mux, term.muxSet = m, true
+}
+
+func currentMux() Mux {
+	if !term.muxSet {
+		term.mux, term.muxSet = DetectMux(), true
+	}
+	return term.mux
+}
+
+// wrapOSC wraps an OSC sequence in the multiplexer's DCS passthrough so it
+// reaches the outer terminal instead of being eaten by tmux or screen.
+// tmux 3.3 and later only pass it on with allow-passthrough enabled.
+func wrapOSC(seq string) string {
+	switch currentMux() {
+	case MuxTmux:
+		return ESC + "Ptmux;" + strings.ReplaceAll(seq, ESC, ESC+ESC) + ESC + "\\"
+	case MuxScreen:
+		return ESC + "P" + seq + ESC + "\\"
+	}
+	return seq
+}
+
+// CopyToClipboard puts text on the system clipboard with OSC 52, where the
+// terminal allows it. Inside tmux the sequence is sent through DCS
+// passthrough, which tmux 3.3 and later drop unless allow-passthrough is on
+// (set -g allow-passthrough on).
+func CopyToClipboard(text string) {
+	writeOutput(wrapOSC(ESC + "]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + BEL))
+}
+
+func SetTitle(title string) {
+	writeOutput(wrapOSC(ESC + "]2;" + title + BEL))
+}
+
 func writeString(s string) {
-	syscall.Write(syscall.Stdout, []byte(s))
+	syscall.Write(outFd, []byte(s))
+}
+
+var defaultCell = Cell{Ch: ' ', Fg: 7, Bg: 0, UnderColor: -1}
+
+func SetDefaultCell(ch rune, fg, bg int) {
+	defaultCell = Cell{Ch: ch, Fg: fg, Bg: bg, UnderColor: -1}
+}
+
+func markRow(y int) {
+	term.buffer.dirtyRows[y] = true
+}
+
+func markAllRows() {
+	for y := range term.buffer.dirtyRows {
+		term.buffer.dirtyRows[y] = true
+	}
+}
+
+func blankCell() Cell {
+	c := defaultCell
+	c.Dirty = true
+	return c
 }
 
 func initBuffer(width, height int) Buffer {
@@ -334,15 +1027,19 @@ func initBuffer(width, height int) Buffer {
 	for i := range cells {
 		cells[i] = make([]Cell, width)
 		for j := range cells[i] {
-			cells[i][j] = Cell{Ch: ' ', Fg: 7, Bg: 0, Dirty: true}
+			cells[i][j] = blankCell()
 		}
 	}
-	return Buffer{Width: width, Height: height, Cells: cells}
+	rows := make([]bool, height)
+	for i := range rows {
+		rows[i] = true
+	}
+	return Buffer{Width: width, Height: height, Cells: cells, dirtyRows: rows}
 }
 
 func Init() error {
 	if term.initialized {
-		return fmt.Errorf("terminal already initialized")
+		return ErrAlreadyInitialized
 	}
 
 	width, height, err := getTermSize()
@@ -362,27 +1059,107 @@ func Init() error {
 	term.eventQueue = make([]Event, 0, 256)
 	term.initialized = true
 	term.isRaw = true
-	term.currentFg = 7
-	term.currentBg = 0
-	term.cursorVisible = true
+	term.currentFg = defaultCell.Fg
+	term.currentBg = defaultCell.Bg
+	term.cursorVisible = false
 	term.cursorStyle = CursorBlock
 	term.escDelay = 25
+	term.currentUStyle = UnderlineSingle
+	term.currentUColor = -1
+	term.extUnderline = detectExtendedUnderline()
+	term.trueColor = detectTrueColor()
+	term.lineMode = detectLineDrawing()
 
 	term.sigwinchCh = make(chan os.Signal, 1)
 	term.sigcontCh = make(chan os.Signal, 1)
+	if term.sizeCh == nil {
+		term.sizeCh = make(chan struct{}, 1)
+	}
 	signal.Notify(term.sigwinchCh, syscall.SIGWINCH)
 	signal.Notify(term.sigcontCh, syscall.SIGCONT)
-	go handleSigwinch()
-	go handleSigcont()
+	go handleSigwinch(term.sigwinchCh)
+	go handleSigcont(term.sigcontCh)
 
 	writeString(AlternateScreen)
 	writeString(HideCursor)
 	writeString(ClearScreen)
+	term.altScreen = true
+
+	return nil
+}
+
+// RenderOnce draws a single frame onto the normal screen and leaves it
+// there, for capturing output with script or asciinema. There is no raw
+// mode, alternate screen or input handling; draw uses the usual drawing
+// calls and the frame is presented once it returns. The screen isn't
+// cleared first: every cell of the frame is written over what was there.
+// If draw panics, the state is still reset so Init can run afterwards.
+func RenderOnce(draw func()) error {
+	if term.initialized {
+		return ErrAlreadyInitialized
+	}
+	width, height, err := getTermSize()
+	if err != nil {
+		return err
+	}
+	term.width = width
+	term.height = height
+	term.buffer = initBuffer(width, height)
+	term.backBuffer = initBuffer(width, height)
+	term.initialized = true
+	term.currentFg = defaultCell.Fg
+	term.currentBg = defaultCell.Bg
+	term.currentUStyle = UnderlineSingle
+	term.currentUColor = -1
+	term.lineMode = detectLineDrawing()
+	term.trueColor = detectTrueColor()
+	defer func() {
+		term = Terminal{sizeCh: term.sizeCh}
+	}()
+
+	draw()
+	Invalidate()
+	Present()
+	// Park the cursor under the frame so the shell prompt doesn't land on it.
+	writeString(fmt.Sprintf(ESC+"[%d;1H", height) + ResetColor + "\r\n")
+	return nil
+}
 
+func InitTTY(path string) error {
+	if term.initialized {
+		return ErrAlreadyInitialized
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	ttyFile = f
+	inFd, outFd = int(f.Fd()), int(f.Fd())
+	if err := Init(); err != nil {
+		releaseTTY()
+		return err
+	}
 	return nil
 }
 
+func releaseTTY() {
+	if ttyFile != nil {
+		ttyFile.Close()
+		ttyFile = nil
+	}
+	inFd, outFd = int(syscall.Stdin), int(syscall.Stdout)
+}
+
+func FileDescriptors() (in, out int) {
+	return inFd, outFd
+}
+
+// Close restores the terminal. It is safe to call more than once, including
+// concurrently from a panic handler and a deferred call; only the first call
+// after Init does anything.
 func Close() error {
+	jobMu.Lock()
+	defer jobMu.Unlock()
 	if !term.initialized {
 		return nil
 	}
@@ -393,54 +1170,293 @@ func Close() error {
 	if term.pasteEnabled {
 		writeString(DisableBracketPaste)
 	}
+	if term.focusEnabled {
+		writeString(DisableFocusMode)
+	}
+
+	restoreOSCColors()
 
 	signal.Stop(term.sigwinchCh)
 	signal.Stop(term.sigcontCh)
 	close(term.sigwinchCh)
 	close(term.sigcontCh)
+	if term.exitSigCh != nil {
+		signal.Stop(term.exitSigCh)
+		close(term.exitSigCh)
+	}
 
 	writeString(ShowCursor)
-	writeString(NormalScreen)
+	if term.cursorStyled {
+		writeString(DefaultCursor)
+	}
+	if term.cursorColored {
+		writeString(wrapOSC(ResetCursorColor))
+	}
+	if term.scrollRegion {
+		writeString(ResetScrollMargins)
+	}
+	if term.altScreen || term.suspended {
+		writeString(NormalScreen)
+	} else {
+		restoreNormalScreen()
+	}
 	writeString(ResetColor)
 
 	err := disableRawMode()
-	term.initialized = false
-	term.isRaw = false
+	releaseTTY()
+	// Start the next Init from scratch; only the SizeChanged channel
+	// outlives a session so callers can keep selecting on it.
+	term = Terminal{sizeCh: term.sizeCh}
 	return err
 }
 
 func Clear() {
-	term.currentFg = 7
-	term.currentBg = 0
+	term.currentFg = defaultCell.Fg
+	term.currentBg = defaultCell.Bg
 	term.currentBold = false
 	term.currentItalic = false
 	term.currentUnder = false
 	term.currentRev = false
+	term.currentStrike = false
+	term.currentUStyle = UnderlineSingle
+	term.currentUColor = -1
 
 	for y := 0; y < term.height; y++ {
 		for x := 0; x < term.width; x++ {
-			term.buffer.Cells[y][x] = Cell{Ch: ' ', Fg: 7, Bg: 0, Dirty: true}
+			term.buffer.Cells[y][x] = blankCell()
 			term.backBuffer.Cells[y][x] = Cell{Ch: 'X', Fg: 0, Bg: 0, Dirty: false}
 		}
 	}
+	markAllRows()
+	term.maybeBlank = true
 }
 
-func SetCell(x, y int, ch rune, fg, bg int) {
-	if x < 0 || x >= term.width || y < 0 || y >= term.height {
-		return
-	}
-	cell := &term.buffer.Cells[y][x]
-	if cell.Ch != ch || cell.Fg != fg || cell.Bg != bg ||
-		cell.Bold != term.currentBold || cell.Italic != term.currentItalic ||
-		cell.Under != term.currentUnder || cell.Rev != term.currentRev {
-		cell.Ch = ch
-		cell.Fg = fg
-		cell.Bg = bg
-		cell.Bold = term.currentBold
-		cell.Italic = term.currentItalic
-		cell.Under = term.currentUnder
-		cell.Rev = term.currentRev
-		cell.Dirty = true
+func Invalidate() {
+	for y := 0; y < term.height; y++ {
+		for x := 0; x < term.width; x++ {
+			term.buffer.Cells[y][x].Dirty = true
+			term.backBuffer.Cells[y][x] = Cell{Ch: -1, Fg: -1, Bg: -1, UnderColor: -1}
+		}
+	}
+	markAllRows()
+}
+
+// SetStrictBounds makes drawing outside the screen get reported to the
+// debug writer instead of being silently dropped.
+func SetStrictBounds(enabled bool) {
+	term.strictBounds = enabled
+}
+
+func SetDebugWriter(w io.Writer) {
+	term.debugW = w
+}
+
+func checkBounds(x, y int) {
+	if !term.strictBounds || term.debugW == nil {
+		return
+	}
+	if x >= 0 && x < term.width && y >= 0 && y < term.height {
+		return
+	}
+	fmt.Fprintf(term.debugW, "tinybox: draw at %d,%d outside %dx%d screen from %s\n", x, y, term.width, term.height, outsideCaller())
+}
+
+// outsideCaller names the first caller up the stack that isn't tinybox.
+func outsideCaller() string {
+	self := runtime.FuncForPC(reflect.ValueOf(outsideCaller).Pointer()).Name()
+	pkg := self[:strings.LastIndex(self, ".")+1]
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, pkg) {
+			return fmt.Sprintf("%s (%s:%d)", f.Function, f.File, f.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+func inClip(x, y int) bool {
+	if x < 0 || x >= term.width || y < 0 || y >= term.height {
+		return false
+	}
+	if n := len(term.clipStack); n > 0 {
+		c := term.clipStack[n-1]
+		if x < c.X || x >= c.X+c.W || y < c.Y || y >= c.Y+c.H {
+			return false
+		}
+	}
+	return true
+}
+
+func SetCell(x, y int, ch rune, fg, bg int) {
+	x += term.offsetX
+	y += term.offsetY
+	if !inClip(x, y) {
+		checkBounds(x, y)
+		return
+	}
+	putCell(x, y, styledCell(ch, fg, bg))
+}
+
+func styledCell(ch rune, fg, bg int) Cell {
+	return Cell{
+		Ch:         ch,
+		Fg:         fg,
+		Bg:         bg,
+		Bold:       term.currentBold,
+		Italic:     term.currentItalic,
+		Under:      term.currentUnder,
+		UnderStyle: term.currentUStyle,
+		UnderColor: term.currentUColor,
+		Rev:        term.currentRev,
+		Strike:     term.currentStrike,
+	}
+}
+
+func putCell(x, y int, c Cell) {
+	cell := &term.buffer.Cells[y][x]
+	// Only a different glyph can change how wide the cell is; recoloring a
+	// wide character keeps its continuation cells.
+	if cell.Ch != c.Ch || cell.Seq != c.Seq || cell.Cont != c.Cont {
+		breakWide(x, y, c.Cont)
+	}
+	if !cell.Equal(c) {
+		c.Dirty = true
+		*cell = c
+		markRow(y)
+	}
+}
+
+// breakWide blanks what would be left of a wide character once the cell at
+// x, y is overwritten: its other half, or the continuation cells trailing a
+// lead cell. Writing a continuation over a continuation is part of drawing
+// a new wide character and leaves the row alone.
+func breakWide(x, y int, cont bool) {
+	row := term.buffer.Cells[y]
+	blank := func(i int) {
+		b := blankCell()
+		b.Bg = row[i].Bg
+		row[i] = b
+		markRow(y)
+	}
+	if row[x].Cont && !cont {
+		for i := x - 1; i >= 0; i-- {
+			lead := !row[i].Cont
+			blank(i)
+			if lead {
+				break
+			}
+		}
+	}
+	if !row[x].Cont || !cont {
+		for i := x + 1; i < len(row) && row[i].Cont; i++ {
+			blank(i)
+		}
+	}
+}
+
+// DrawCells copies cells into row y from x as they are, one per column,
+// through the offset and clip stacks. Wide characters need their Cont
+// cells included.
+func DrawCells(x, y int, cells []Cell) {
+	x += term.offsetX
+	y += term.offsetY
+	for i, c := range cells {
+		if inClip(x+i, y) {
+			putCell(x+i, y, c)
+		}
+	}
+}
+
+// DrawRunes draws runes from x in fg, bg and the current attributes,
+// reusing one template cell. Wide runes take two columns like in PrintAt;
+// zero-width runes are skipped, so text with combining marks needs PrintAt.
+func DrawRunes(x, y int, runes []rune, fg, bg int) {
+	x += term.offsetX
+	y += term.offsetY
+	tmpl := styledCell(0, fg, bg)
+	cont := tmpl
+	cont.Cont = true
+	for _, ch := range runes {
+		w := RuneWidth(ch)
+		if w == 0 {
+			continue
+		}
+		if inClip(x, y) && inClip(x+w-1, y) {
+			tmpl.Ch = ch
+			putCell(x, y, tmpl)
+			if w == 2 {
+				putCell(x+1, y, cont)
+			}
+		}
+		x += w
+	}
+}
+
+func PushClip(x, y, w, h int) {
+	x += term.offsetX
+	y += term.offsetY
+	x0, y0, x1, y1 := 0, 0, term.width, term.height
+	if n := len(term.clipStack); n > 0 {
+		c := term.clipStack[n-1]
+		x0, y0, x1, y1 = c.X, c.Y, c.X+c.W, c.Y+c.H
+	}
+	x0, y0 = max(x0, x), max(y0, y)
+	x1, y1 = min(x1, x+w), min(y1, y+h)
+	term.clipStack = append(term.clipStack, Rect{X: x0, Y: y0, W: max(x1-x0, 0), H: max(y1-y0, 0)})
+}
+
+func PopClip() {
+	if n := len(term.clipStack); n > 0 {
+		term.clipStack = term.clipStack[:n-1]
+	}
+}
+
+// PushColor sets the current colors until the matching PopColor, which
+// restores the ones in effect before.
+func PushColor(fg, bg int) {
+	term.colorStack = append(term.colorStack, CurrentStyle())
+	term.currentFg, term.currentBg = fg, bg
+}
+
+func PopColor() {
+	if n := len(term.colorStack); n > 0 {
+		prev := term.colorStack[n-1]
+		term.colorStack = term.colorStack[:n-1]
+		term.currentFg, term.currentBg = prev.Fg, prev.Bg
+	}
+}
+
+// PushAttr is PushColor for the attributes set by SetAttr and Strike.
+func PushAttr(bold, italic, underline, reverse, strike bool) {
+	term.attrStack = append(term.attrStack, CurrentStyle())
+	SetAttr(bold, italic, underline, reverse)
+	Strike(strike)
+}
+
+func PopAttr() {
+	if n := len(term.attrStack); n > 0 {
+		prev := term.attrStack[n-1]
+		term.attrStack = term.attrStack[:n-1]
+		SetAttr(prev.Bold, prev.Italic, prev.Under, prev.Rev)
+		Strike(prev.Strike)
+	}
+}
+
+func PushOffset(dx, dy int) {
+	term.offsetStack = append(term.offsetStack, offset{dx: term.offsetX, dy: term.offsetY})
+	term.offsetX += dx
+	term.offsetY += dy
+}
+
+func PopOffset() {
+	if n := len(term.offsetStack); n > 0 {
+		prev := term.offsetStack[n-1]
+		term.offsetStack = term.offsetStack[:n-1]
+		term.offsetX, term.offsetY = prev.dx, prev.dy
 	}
 }
 
@@ -448,521 +1464,3453 @@ func Present() {
 	if term.width == 0 || term.height == 0 {
 		return
 	}
+	if !term.tooSmall && (term.width < term.minWidth || term.height < term.minHeight) {
+		presentTooSmall()
+		return
+	}
+
+	selSaved := applySelection()
+
+	var softCell *Cell
+	var softSaved Cell
+	if term.softCursor && term.softX >= 0 && term.softX < term.width && term.softY >= 0 && term.softY < term.height {
+		softCell = &term.buffer.Cells[term.softY][term.softX]
+		softSaved = *softCell
+		if softCursorLit() {
+			if term.softStyle == CursorUnderline {
+				softCell.Under = !softCell.Under
+			} else {
+				softCell.Rev = !softCell.Rev
+			}
+		}
+		softCell.Dirty = true
+		markRow(term.softY)
+	}
 
-	output := make([]byte, 0, term.width*term.height)
+	// The frame is built in a buffer kept from the last Present, so steady
+	// state rendering doesn't allocate.
+	output := term.outBuf[:0]
+	if term.syncOutput {
+		output = append(output, seqBeginSync...)
+	}
 	lastY, lastX := -1, -1
-	activeFg, activeBg := -1, -1
-	activeBold, activeItalic, activeUnder, activeRev := false, false, false, false
+	p := newPen()
 	var runeBuf [utf8.UTFMax]byte
 	dirtyWritten := false
+	stats := Stats{}
+
+	// Keep a visible cursor from being dragged across the screen while
+	// cells are drawn; it's shown again at its own position at the end.
+	hideStart := len(output)
+	hide := term.cursorVisible && !term.showDuringRender
+	if hide {
+		output = append(output, seqHideCursor...)
+	}
+
+	if !term.altScreen {
+		trackNormalRows()
+	}
+
+	// Clearing the whole screen is only a shortcut on the alternate screen;
+	// on the normal one it would wipe what the user had there.
+	if term.maybeBlank {
+		term.maybeBlank = false
+		if term.altScreen && screenBlank() {
+			output = p.apply(output, &term.buffer.Cells[0][0])
+			output = append(output, seqClearScreen...)
+			output = append(output, seqHome...)
+			for y := 0; y < term.height; y++ {
+				for x := 0; x < term.width; x++ {
+					term.backBuffer.Cells[y][x] = term.buffer.Cells[y][x]
+					term.buffer.Cells[y][x].Dirty = false
+				}
+				term.buffer.dirtyRows[y] = false
+			}
+			stats.CellsWritten = term.width * term.height
+			dirtyWritten = true
+		}
+	}
+
+	if term.renderMode == RenderFull && !dirtyWritten {
+		output = appendFullFrame(output, &p, &stats)
+		dirtyWritten = true
+	}
 
 	for y := 0; y < term.height; y++ {
+		if !term.buffer.dirtyRows[y] {
+			continue
+		}
+		term.buffer.dirtyRows[y] = false
+		eraseFrom := blankTail(y)
 		for x := 0; x < term.width; x++ {
 			curr := &term.buffer.Cells[y][x]
 			back := &term.backBuffer.Cells[y][x]
 
+			if x == eraseFrom {
+				if lastY != y || lastX != x {
+					output = appendCursorMove(output, y+1, x+1)
+					stats.CursorMoves++
+				}
+				output = p.apply(output, curr)
+				output = append(output, seqClearToEOL...)
+				for k := x; k < term.width; k++ {
+					c, b := &term.buffer.Cells[y][k], &term.backBuffer.Cells[y][k]
+					if !c.Equal(*b) {
+						stats.CellsWritten++
+					}
+					*b = *c
+					c.Dirty = false
+				}
+				dirtyWritten = true
+				lastY = -1
+				break
+			}
+
 			if !curr.Dirty {
 				continue
 			}
+			stats.CellsConsidered++
+
+			if curr.Equal(*back) {
+				curr.Dirty = false
+				continue
+			}
 
-			if curr.Ch == back.Ch && curr.Fg == back.Fg && curr.Bg == back.Bg &&
-				curr.Bold == back.Bold && curr.Italic == back.Italic &&
-				curr.Under == back.Under && curr.Rev == back.Rev {
+			if curr.Cont {
+				*back = *curr
 				curr.Dirty = false
 				continue
 			}
 
 			if lastY != y || lastX != x {
 				output = appendCursorMove(output, y+1, x+1)
+				stats.CursorMoves++
 			}
 
-			if curr.Bold != activeBold {
-				if curr.Bold {
-					output = append(output, seqSetBold...)
-				} else {
-					output = append(output, seqUnsetBold...)
-				}
-				activeBold = curr.Bold
-			}
-			if curr.Italic != activeItalic {
-				if curr.Italic {
-					output = append(output, seqSetItalic...)
-				} else {
-					output = append(output, seqUnsetItalic...)
-				}
-				activeItalic = curr.Italic
-			}
-			if curr.Under != activeUnder {
-				if curr.Under {
-					output = append(output, seqSetUnderline...)
-				} else {
-					output = append(output, seqUnsetUnderline...)
+			output = p.apply(output, curr)
+
+			run := 0
+			if curr.Seq != "" {
+				output = append(output, curr.Seq...)
+			} else {
+				n := utf8.EncodeRune(runeBuf[:], curr.Ch)
+				output = append(output, runeBuf[:n]...)
+				if term.repOutput {
+					run = repeatRun(y, x, eraseFrom)
 				}
-				activeUnder = curr.Under
 			}
-			if curr.Rev != activeRev {
-				if curr.Rev {
-					output = append(output, seqSetReverse...)
-				} else {
-					output = append(output, seqUnsetReverse...)
+			if run >= repMinRun {
+				output = append(output, '', '[')
+				output = appendInt(output, run)
+				output = append(output, 'b')
+				for k := x + 1; k <= x+run; k++ {
+					term.backBuffer.Cells[y][k] = *curr
+					term.buffer.Cells[y][k].Dirty = false
 				}
-				activeRev = curr.Rev
-			}
-
-			if curr.Fg != activeFg {
-				output = appendSet256Color(output, true, curr.Fg)
-				activeFg = curr.Fg
-			}
-			if curr.Bg != activeBg {
-				output = appendSet256Color(output, false, curr.Bg)
-				activeBg = curr.Bg
+				stats.CellsWritten += run
+			} else {
+				run = 0
 			}
 
-			n := utf8.EncodeRune(runeBuf[:], curr.Ch)
-			output = append(output, runeBuf[:n]...)
-
 			*back = *curr
 			curr.Dirty = false
 			dirtyWritten = true
-			lastY, lastX = y, x+1
+			stats.CellsWritten++
+			lastY, lastX = y, x+1+run
+			for lastX < term.width && term.buffer.Cells[y][lastX].Cont {
+				lastX++
+			}
 		}
 	}
 
 	if dirtyWritten {
 		output = append(output, resetColorSeq...)
-		activeFg, activeBg = 7, 0
-		activeBold, activeItalic, activeUnder, activeRev = false, false, false, false
+	} else if hide {
+		output = output[:hideStart]
+		hide = false
 	}
 
 	if term.cursorVisible && (term.cursorX >= 0 && term.cursorY >= 0) {
 		output = appendCursorMove(output, term.cursorY+1, term.cursorX+1)
+		stats.CursorMoves++
+	}
+	if hide {
+		output = append(output, seqShowCursor...)
 	}
 
-	if len(output) > 0 {
-		syscall.Write(syscall.Stdout, output)
+	if softCell != nil {
+		softSaved.Dirty = false
+		*softCell = softSaved
 	}
-}
+	restoreSelection(selSaved)
 
-func appendCursorMove(out []byte, row, col int) []byte {
-	if row < 1 {
-		row = 1
+	if term.syncOutput {
+		if len(output) == len(seqBeginSync) {
+			output = output[:0]
+		} else {
+			output = append(output, seqEndSync...)
+		}
 	}
-	if col < 1 {
-		col = 1
+
+	if term.flushMode == ManualFlush {
+		term.pending = append(term.pending, output...)
+	} else if len(output) > 0 {
+		syscall.Write(outFd, output)
 	}
-	out = append(out, '', '[')
-	out = appendInt(out, row)
-	out = append(out, ';')
-	out = appendInt(out, col)
-	return append(out, 'H')
+	stats.BytesWritten = len(output)
+	term.stats = stats
+	term.outBuf = output[:0]
 }
 
-func appendSet256Color(out []byte, fg bool, value int) []byte {
-	if value < 0 {
-		value = 0
-	} else if value > 255 {
-		value = 255
+// BufferEqual reports whether a and b have the same size and cells, going
+// by Cell.Equal.
+func BufferEqual(a, b Buffer) bool {
+	if a.Width != b.Width || a.Height != b.Height || len(a.Cells) != len(b.Cells) {
+		return false
 	}
-	out = append(out, '', '[')
-	if fg {
-		out = append(out, '3', '8')
-	} else {
-		out = append(out, '4', '8')
+	for y := range a.Cells {
+		if len(a.Cells[y]) != len(b.Cells[y]) {
+			return false
+		}
+		for x := range a.Cells[y] {
+			if !a.Cells[y][x].Equal(b.Cells[y][x]) {
+				return false
+			}
+		}
 	}
-	out = append(out, ';', '5', ';')
-	out = appendInt(out, value)
-	return append(out, 'm')
+	return true
 }
 
-func appendInt(out []byte, value int) []byte {
-	return strconv.AppendInt(out, int64(value), 10)
+// Snapshot returns a copy of the buffer being drawn to, for use with Diff.
+func Snapshot() Buffer {
+	cells := make([][]Cell, term.height)
+	for y := range cells {
+		cells[y] = append([]Cell(nil), term.buffer.Cells[y]...)
+	}
+	return Buffer{Width: term.width, Height: term.height, Cells: cells}
 }
 
-func DrawTextLeft(y int, text string, fg, bg int) {
-	for i, ch := range text {
-		if i < term.width {
-			SetCell(i, y, ch, fg, bg)
-		}
-	}
+type CellChange struct {
+	X, Y int
+	Cell Cell
 }
 
-func DrawTextCenter(y int, text string, fg, bg int) {
-	startX := (term.width - len(text)) / 2
-	if startX < 0 {
-		startX = 0
-	}
-	for i, ch := range text {
-		x := startX + i
-		if x < term.width {
-			SetCell(x, y, ch, fg, bg)
+// Diff lists the cells of next that differ from prev, row by row. Cells
+// outside prev's bounds always count as changed. The Dirty flag is ignored.
+func Diff(prev, next Buffer) []CellChange {
+	var changes []CellChange
+	for y, row := range next.Cells {
+		for x := range row {
+			c := &row[x]
+			if y < len(prev.Cells) && x < len(prev.Cells[y]) && c.Equal(prev.Cells[y][x]) {
+				continue
+			}
+			change := CellChange{X: x, Y: y, Cell: *c}
+			change.Cell.Dirty = false
+			changes = append(changes, change)
 		}
 	}
+	return changes
 }
 
-func DrawTextRight(y int, text string, fg, bg int) {
-	startX := term.width - len(text)
-	if startX < 0 {
-		startX = 0
-	}
-	for i, ch := range text {
-		x := startX + i
-		if x < term.width && x >= 0 {
-			SetCell(x, y, ch, fg, bg)
-		}
+// Frames written by EncodeFrame start with frameMagic and a version byte,
+// followed by a uvarint change count. Each change is uvarint x and y, varint
+// rune, fg, bg and underline color, a flags byte, the underline style and a
+// length-prefixed Seq.
+const frameVersion = 1
+
+var frameMagic = []byte("TBF")
+
+const (
+	frameBold = 1 << iota
+	frameItalic
+	frameUnder
+	frameRev
+	frameStrike
+	frameCont
+)
+
+var ErrBadFrame = errors.New("tinybox: malformed frame")
+
+func EncodeFrame(w io.Writer, changes []CellChange) error {
+	out := append([]byte(nil), frameMagic...)
+	out = append(out, frameVersion)
+	out = binary.AppendUvarint(out, uint64(len(changes)))
+	for _, ch := range changes {
+		c := &ch.Cell
+		out = binary.AppendUvarint(out, uint64(ch.X))
+		out = binary.AppendUvarint(out, uint64(ch.Y))
+		out = binary.AppendVarint(out, int64(c.Ch))
+		out = binary.AppendVarint(out, int64(c.Fg))
+		out = binary.AppendVarint(out, int64(c.Bg))
+		out = binary.AppendVarint(out, int64(c.UnderColor))
+		out = append(out, cellFlags(c), byte(c.UnderStyle))
+		out = binary.AppendUvarint(out, uint64(len(c.Seq)))
+		out = append(out, c.Seq...)
 	}
+	_, err := w.Write(out)
+	return err
 }
 
-func ClearLine(y int) {
-	for x := 0; x < term.width; x++ {
-		SetCell(x, y, ' ', 7, 0)
+func cellFlags(c *Cell) byte {
+	var flags byte
+	set := func(on bool, bit byte) {
+		if on {
+			flags |= bit
+		}
 	}
+	set(c.Bold, frameBold)
+	set(c.Italic, frameItalic)
+	set(c.Under, frameUnder)
+	set(c.Rev, frameRev)
+	set(c.Strike, frameStrike)
+	set(c.Cont, frameCont)
+	return flags
 }
 
-func GetTerminalSize() (width, height int) {
-	return term.width, term.height
+// oneByteReader reads without buffering so DecodeFrame never consumes bytes
+// past the end of its frame.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(o.r, b[:])
+	return b[0], err
 }
 
-func PollEvent() (Event, error) {
-	if len(term.eventQueue) > 0 {
-		evt := term.eventQueue[0]
-		term.eventQueue = term.eventQueue[1:]
-		return evt, nil
+func DecodeFrame(r io.Reader) ([]CellChange, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = oneByteReader{r}
+	}
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		for i := range buf {
+			b, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			buf[i] = b
+		}
+		return buf, nil
 	}
 
-	var buf [16]byte
-	n, err := syscall.Read(syscall.Stdin, buf[:])
+	head, err := read(len(frameMagic) + 1)
 	if err != nil {
-		return Event{}, err
+		return nil, err
 	}
-	if n == 0 {
-		return Event{}, fmt.Errorf("no input")
+	if !bytes.Equal(head[:len(frameMagic)], frameMagic) {
+		return nil, ErrBadFrame
+	}
+	if head[len(frameMagic)] != frameVersion {
+		return nil, fmt.Errorf("tinybox: unsupported frame version %d", head[len(frameMagic)])
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
 	}
 
-	return parseInput(buf[:n])
+	var changes []CellChange
+	for i := uint64(0); i < count; i++ {
+		var ch CellChange
+		var u [2]uint64
+		for j := range u {
+			if u[j], err = binary.ReadUvarint(br); err != nil {
+				return nil, err
+			}
+		}
+		var v [4]int64
+		for j := range v {
+			if v[j], err = binary.ReadVarint(br); err != nil {
+				return nil, err
+			}
+		}
+		tail, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > 1<<16 {
+			return nil, ErrBadFrame
+		}
+		seq, err := read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		flags := tail[0]
+		ch.X, ch.Y = int(u[0]), int(u[1])
+		ch.Cell = Cell{
+			Ch:         rune(v[0]),
+			Fg:         int(v[1]),
+			Bg:         int(v[2]),
+			UnderColor: int(v[3]),
+			Bold:       flags&frameBold != 0,
+			Italic:     flags&frameItalic != 0,
+			Under:      flags&frameUnder != 0,
+			Rev:        flags&frameRev != 0,
+			Strike:     flags&frameStrike != 0,
+			Cont:       flags&frameCont != 0,
+			UnderStyle: UnderlineStyle(tail[1]),
+			Seq:        string(seq),
+		}
+		changes = append(changes, ch)
+	}
+	return changes, nil
 }
 
-func PollEventTimeout(timeout time.Duration) (Event, error) {
-	if len(term.eventQueue) > 0 {
-		evt := term.eventQueue[0]
-		term.eventQueue = term.eventQueue[1:]
-		return evt, nil
+// ApplyChanges writes changes into the buffer at their absolute positions;
+// the clip and offset stacks don't apply.
+func ApplyChanges(changes []CellChange) {
+	for _, ch := range changes {
+		if ch.X < 0 || ch.X >= term.width || ch.Y < 0 || ch.Y >= term.height {
+			continue
+		}
+		putCell(ch.X, ch.Y, ch.Cell)
 	}
+}
 
-	fd := int(syscall.Stdin)
-	fdSet := &syscall.FdSet{}
-	setFd(fdSet, fd)
-
-	tv := syscall.Timeval{
-		Sec:  int64(timeout / time.Second),
-		Usec: int64((timeout % time.Second) / time.Microsecond),
-	}
+// SetMinimumSize makes Present show a "terminal too small" notice instead
+// of the buffer while the screen is smaller than width x height. Zero turns
+// the check off.
+func SetMinimumSize(width, height int) {
+	term.minWidth, term.minHeight = width, height
+	Invalidate()
+}
 
-	n, err := selectRead(fd, fdSet, &tv)
-	if err != nil {
-		return Event{}, err
+// presentTooSmall presents the notice from a scratch buffer, leaving the
+// app's buffer untouched for when the screen grows back.
+func presentTooSmall() {
+	app, clips, offs := term.buffer, term.clipStack, term.offsetStack
+	ox, oy, style := term.offsetX, term.offsetY, CurrentStyle()
+	if term.tooSmallBuf.Width != term.width || term.tooSmallBuf.Height != term.height {
+		term.tooSmallBuf = initBuffer(term.width, term.height)
+	} else {
+		for _, row := range term.tooSmallBuf.Cells {
+			for x := range row {
+				row[x] = blankCell()
+			}
+		}
 	}
-	if n <= 0 {
-		return Event{}, fmt.Errorf("timeout")
+	term.buffer = term.tooSmallBuf
+	markAllRows()
+	term.clipStack, term.offsetStack, term.offsetX, term.offsetY = nil, nil, 0, 0
+
+	msg := fmt.Sprintf("terminal too small (need %dx%d)", term.minWidth, term.minHeight)
+	lines := wrapText(msg, term.width)
+	top := max((term.height-len(lines))/2, 0)
+	for i, line := range lines {
+		DrawTextCenterIn(0, top+i, term.width, line, defaultCell.Fg, defaultCell.Bg)
 	}
+	term.tooSmall = true
+	Present()
+	term.tooSmall = false
 
-	return PollEvent()
+	term.buffer, term.clipStack, term.offsetStack = app, clips, offs
+	term.offsetX, term.offsetY = ox, oy
+	SetStyle(style)
+	markAllRows()
 }
 
-func parseSGRMouse(buf []byte) (Event, error) {
-	// SGR format: \033[<button;x;y[Mm]
-	if len(buf) < 9 || buf[0] != 27 || buf[1] != '[' || buf[2] != '<' {
-		return Event{}, fmt.Errorf("not SGR mouse format")
+// Equal reports whether c and other look the same on screen, which is
+// everything but Dirty.
+func (c Cell) Equal(other Cell) bool {
+	return c.Ch == other.Ch && c.Fg == other.Fg && c.Bg == other.Bg &&
+		c.Bold == other.Bold && c.Italic == other.Italic &&
+		c.Under == other.Under && c.Rev == other.Rev &&
+		c.Strike == other.Strike && c.UnderStyle == other.UnderStyle &&
+		c.UnderColor == other.UnderColor && c.Seq == other.Seq && c.Cont == other.Cont
+}
+
+// screenBlank reports whether every cell is a plain blank with the same
+// background, so one ESC[2J reproduces the whole buffer.
+func screenBlank() bool {
+	bg := term.buffer.Cells[0][0].Bg
+	for y := 0; y < term.height; y++ {
+		for x := 0; x < term.width; x++ {
+			c := &term.buffer.Cells[y][x]
+			if !isPlainBlank(c) || c.Bg != bg {
+				return false
+			}
+		}
 	}
+	return true
+}
 
-	i := 3
-	button, next, ok := parseDecimal(buf, i)
-	if !ok {
-		return Event{}, fmt.Errorf("invalid SGR mouse button")
+func isPlainBlank(c *Cell) bool {
+	return c.Ch == ' ' && c.Seq == "" && !c.Cont && !c.Under && !c.Rev && !c.Strike
+}
+
+// blankTail returns where a row's run of plain blanks with one background
+// starts, if the run reaches the right edge, is long enough that ESC[K beats
+// writing spaces, and has something to repaint. Otherwise it returns -1.
+func blankTail(y int) int {
+	row, back := term.buffer.Cells[y], term.backBuffer.Cells[y]
+	last := &row[term.width-1]
+	if !isPlainBlank(last) {
+		return -1
 	}
-	i = next
-	if i >= len(buf) || buf[i] != ';' {
-		return Event{}, fmt.Errorf("invalid SGR mouse separator")
+	start := term.width - 1
+	for start > 0 && isPlainBlank(&row[start-1]) && row[start-1].Bg == last.Bg {
+		start--
 	}
-	i++
-
-	x, next, ok := parseDecimal(buf, i)
-	if !ok {
-		return Event{}, fmt.Errorf("invalid SGR mouse x")
+	if term.width-start < eraseMinRun {
+		return -1
 	}
-	i = next
-	if i >= len(buf) || buf[i] != ';' {
-		return Event{}, fmt.Errorf("invalid SGR mouse separator")
+	for k := start; k < term.width; k++ {
+		if row[k].Dirty && !row[k].Equal(back[k]) {
+			return start
+		}
 	}
-	i++
+	return -1
+}
 
-	y, next, ok := parseDecimal(buf, i)
-	if !ok {
-		return Event{}, fmt.Errorf("invalid SGR mouse y")
-	}
-	i = next
-	if i >= len(buf) {
-		return Event{}, fmt.Errorf("no SGR terminator found")
+// appendFullFrame writes every cell without consulting the back buffer,
+// one cursor move per row, leaving the buffers as an incremental Present
+// would so the render mode can be switched at any time.
+func appendFullFrame(output []byte, p *pen, stats *Stats) []byte {
+	var runeBuf [utf8.UTFMax]byte
+	for y := 0; y < term.height; y++ {
+		output = appendCursorMove(output, y+1, 1)
+		stats.CursorMoves++
+		row, back := term.buffer.Cells[y], term.backBuffer.Cells[y]
+		for x := range row {
+			curr := &row[x]
+			curr.Dirty = false
+			back[x] = *curr
+			if curr.Cont {
+				continue
+			}
+			output = p.apply(output, curr)
+			if curr.Seq != "" {
+				output = append(output, curr.Seq...)
+			} else {
+				n := utf8.EncodeRune(runeBuf[:], curr.Ch)
+				output = append(output, runeBuf[:n]...)
+			}
+			stats.CellsWritten++
+		}
+		term.buffer.dirtyRows[y] = false
 	}
+	stats.CellsConsidered = term.width * term.height
+	return output
+}
 
-	press := false
-	switch buf[i] {
-	case 'M':
-		press = true
-	case 'm':
-		press = false
-	default:
-		return Event{}, fmt.Errorf("invalid SGR mouse terminator")
+// repeatRun counts the cells after x on row y that repeat the one at x and
+// could be sent with REP instead, stopping at end, where ESC[K takes over.
+func repeatRun(y, x, end int) int {
+	row := term.buffer.Cells[y]
+	curr := &row[x]
+	if curr.Cont || RuneWidth(curr.Ch) != 1 {
+		return 0
 	}
-
-	var mouseButton MouseButton
-	switch button & 3 {
-	case 0:
-		mouseButton = MouseLeft
-	case 1:
-		mouseButton = MouseMiddle
-	case 2:
-		mouseButton = MouseRight
+	if end < 0 {
+		end = term.width
 	}
-
-	if button >= 64 {
-		if button&1 != 0 {
-			mouseButton = MouseWheelDown
-		} else {
-			mouseButton = MouseWheelUp
-		}
+	k := x + 1
+	for k < end && row[k].Equal(*curr) {
+		k++
 	}
+	return k - x - 1
+}
 
-	return Event{Type: EventMouse, Button: mouseButton, X: x - 1, Y: y - 1, Press: press}, nil
+// pen tracks the SGR state the terminal is in while Present writes a frame.
+type pen struct {
+	fg, bg                           int
+	bold, italic, under, rev, strike bool
+	uStyle                           UnderlineStyle
+	uColor                           int
 }
 
-func parseDecimal(buf []byte, idx int) (value, next int, ok bool) {
-	if idx >= len(buf) {
-		return 0, idx, false
+func newPen() pen {
+	return pen{fg: -1, bg: -1, uStyle: UnderlineSingle, uColor: -1}
+}
+
+func (p *pen) apply(output []byte, curr *Cell) []byte {
+	if curr.Bold != p.bold {
+		if curr.Bold {
+			output = append(output, seqSetBold...)
+		} else {
+			output = append(output, seqUnsetBold...)
+		}
+		p.bold = curr.Bold
 	}
-	start := idx
-	val := 0
-	for idx < len(buf) {
-		b := buf[idx]
-		if b < '0' || b > '9' {
-			break
+	if curr.Italic != p.italic {
+		if curr.Italic {
+			output = append(output, seqSetItalic...)
+		} else {
+			output = append(output, seqUnsetItalic...)
 		}
-		val = val*10 + int(b-'0')
-		idx++
+		p.italic = curr.Italic
 	}
-	if idx == start {
-		return 0, idx, false
+	if curr.Under != p.under || (curr.Under && term.extUnderline && curr.UnderStyle != p.uStyle) {
+		if curr.Under {
+			output = appendUnderline(output, curr.UnderStyle)
+		} else {
+			output = append(output, seqUnsetUnderline...)
+		}
+		p.under = curr.Under
+		p.uStyle = curr.UnderStyle
+	}
+	if term.extUnderline && curr.UnderColor != p.uColor {
+		if curr.UnderColor < 0 {
+			output = append(output, seqResetUnderCol...)
+		} else {
+			output = appendUnderlineColor(output, curr.UnderColor)
+		}
+		p.uColor = curr.UnderColor
+	}
+	if curr.Rev != p.rev {
+		if curr.Rev {
+			output = append(output, seqSetReverse...)
+		} else {
+			output = append(output, seqUnsetReverse...)
+		}
+		p.rev = curr.Rev
+	}
+	if curr.Strike != p.strike {
+		if curr.Strike {
+			output = append(output, seqSetStrike...)
+		} else {
+			output = append(output, seqUnsetStrike...)
+		}
+		p.strike = curr.Strike
 	}
-	return val, idx, true
-}
 
-func parseInput(buf []byte) (Event, error) {
-	if len(buf) == 0 {
-		return Event{}, fmt.Errorf("no input")
+	if curr.Fg != p.fg {
+		output = appendSet256Color(output, true, curr.Fg)
+		p.fg = curr.Fg
+	}
+	if curr.Bg != p.bg {
+		output = appendSet256Color(output, false, curr.Bg)
+		p.bg = curr.Bg
 	}
+	return output
+}
 
-	ch := buf[0]
+func LastStats() Stats {
+	return term.stats
+}
 
-	if ch == 27 { // ESC
-		if len(buf) == 1 {
-			return Event{Type: EventKey, Key: KeyEscape}, nil
+// Scheduler calls draw and Present on its own goroutine at most once per
+// interval, however often RequestRedraw is called. Code on other goroutines
+// that touches the screen or the state draw reads should go through Update.
+type Scheduler struct {
+	interval time.Duration
+	draw     func()
+	mu       sync.Mutex
+	request  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func NewScheduler(interval time.Duration, draw func()) *Scheduler {
+	s := &Scheduler{
+		interval: interval,
+		draw:     draw,
+		request:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.request:
+		case <-s.stop:
+			return
 		}
-		if len(buf) >= 6 && buf[1] == '[' && buf[2] == '<' {
-			if evt, err := parseSGRMouse(buf); err == nil {
-				return evt, nil
-			}
+		// Let requests pile up for one interval, then draw them all at once.
+		select {
+		case <-time.After(s.interval):
+		case <-s.stop:
+			return
 		}
-		if len(buf) >= 3 && buf[1] == '[' {
-			switch buf[2] {
-			case 'A':
-				return Event{Type: EventKey, Key: KeyArrowUp}, nil
-			case 'B':
-				return Event{Type: EventKey, Key: KeyArrowDown}, nil
-			case 'C':
-				return Event{Type: EventKey, Key: KeyArrowRight}, nil
-			case 'D':
-				return Event{Type: EventKey, Key: KeyArrowLeft}, nil
-			case 'H':
-				return Event{Type: EventKey, Key: KeyHome}, nil
-			case 'F':
-				return Event{Type: EventKey, Key: KeyEnd}, nil
-			case '1':
-				if len(buf) >= 4 && buf[3] == '~' {
-					return Event{Type: EventKey, Key: KeyHome}, nil
-				}
-			case '3':
-				if len(buf) >= 4 && buf[3] == '~' {
-					return Event{Type: EventKey, Key: KeyDelete}, nil
-				}
-			case '5':
-				if len(buf) >= 4 && buf[3] == '~' {
-					return Event{Type: EventKey, Key: KeyPageUp}, nil
-				}
-			case '6':
-				if len(buf) >= 4 && buf[3] == '~' {
-					return Event{Type: EventKey, Key: KeyPageDown}, nil
-				}
-			case 'M':
-				if len(buf) >= 6 {
-					return parseMouseEvent(buf[3:6])
-				}
-			}
-			if len(buf) >= 5 && buf[2] == '1' {
-				switch buf[3] {
-				case '1', '2', '3', '4', '5':
-					if buf[4] == '~' {
-						return Event{Type: EventKey, Key: Key(int(KeyF1) + int(buf[3]-'1'))}, nil
-					}
-				}
-			}
+		select {
+		case <-s.request:
+		default:
 		}
-		return Event{Type: EventKey, Key: KeyEscape}, nil
+		s.mu.Lock()
+		s.draw()
+		Present()
+		s.mu.Unlock()
 	}
+}
 
-	switch ch {
-	case 1:
-		return Event{Type: EventKey, Key: KeyCtrlA}, nil
-	case 3:
-		return Event{Type: EventKey, Key: KeyCtrlC}, nil
-	case 4:
-		return Event{Type: EventKey, Key: KeyCtrlD}, nil
-	case 5:
-		return Event{Type: EventKey, Key: KeyCtrlE}, nil
-	case 9:
-		return Event{Type: EventKey, Key: KeyTab}, nil
-	case 11:
-		return Event{Type: EventKey, Key: KeyCtrlK}, nil
-	case 13:
-		return Event{Type: EventKey, Key: KeyEnter}, nil
-	case 21:
-		return Event{Type: EventKey, Key: KeyCtrlU}, nil
-	case 23:
-		return Event{Type: EventKey, Key: KeyCtrlW}, nil
-	case 127:
-		return Event{Type: EventKey, Key: KeyBackspace}, nil
+func (s *Scheduler) RequestRedraw() {
+	select {
+	case s.request <- struct{}{}:
 	default:
-		return Event{Type: EventKey, Ch: rune(ch)}, nil
 	}
 }
 
-func parseMouseEvent(buf []byte) (Event, error) {
-	if len(buf) < 3 {
-		return Event{}, fmt.Errorf("incomplete mouse event")
+// Update runs fn with no draw in progress, for changes from other
+// goroutines to the screen or to what draw reads. fn must not call Update.
+func (s *Scheduler) Update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// Stop ends the scheduler, dropping any redraw still pending. It waits for
+// a draw in progress to finish and may be called more than once.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// FrameTimer keeps the durations between the last Window calls to EndFrame
+// (60 when Window is zero). Call EndFrame right after each Present.
+type FrameTimer struct {
+	Window  int
+	last    time.Time
+	samples []time.Duration
+	next    int
+}
+
+func (ft *FrameTimer) EndFrame() {
+	now := time.Now()
+	if !ft.last.IsZero() {
+		window := ft.Window
+		if window <= 0 {
+			window = 60
+		}
+		if len(ft.samples) < window {
+			ft.samples = append(ft.samples, now.Sub(ft.last))
+		} else {
+			ft.samples[ft.next%len(ft.samples)] = now.Sub(ft.last)
+			ft.next++
+		}
 	}
+	ft.last = now
+}
 
-	b := buf[0] - 32
-	x := int(buf[1]) - 32
-	y := int(buf[2]) - 32
+func (ft *FrameTimer) AvgFrameTime() time.Duration {
+	if len(ft.samples) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range ft.samples {
+		sum += d
+	}
+	return sum / time.Duration(len(ft.samples))
+}
 
-	var button MouseButton
-	switch b & 3 {
-	case 0:
-		button = MouseLeft
-	case 1:
-		button = MouseMiddle
-	case 2:
-		button = MouseRight
+func (ft *FrameTimer) FPS() float64 {
+	avg := ft.AvgFrameTime()
+	if avg <= 0 {
+		return 0
 	}
+	return float64(time.Second) / float64(avg)
+}
 
-	if b&64 != 0 {
-		if b&1 != 0 {
-			button = MouseWheelDown
-		} else {
-			button = MouseWheelUp
+// WriteAt moves the cursor and writes s straight to the terminal,
+// bypassing both the cell buffer and the back buffer Present diffs against.
+// Since neither records the text, the next Present overwrites it wherever
+// the buffer has changed underneath and leaves it as stale text elsewhere;
+// call Invalidate to repaint over it. Under ManualFlush the write is queued
+// behind whatever Present already queued and goes out with the next Flush.
+func WriteAt(x, y int, s string) {
+	out := appendCursorMove(nil, y+1, x+1)
+	writeOutputBytes(append(out, s...))
+}
+
+// WriteEscape sends a raw escape sequence the library doesn't wrap (a
+// private mode, a custom OSC) through the same output path as Present, so
+// it is ordered correctly and held back under ManualFlush. The cell buffer
+// is left alone. It is a no-op before Init, and strings that don't start
+// with ESC are dropped with a note to the debug writer.
+//
+// Misuse can corrupt rendering. Present tracks the cursor position, the
+// current pen (colors and attributes) and the screen contents; a sequence
+// that moves the cursor, sets SGR attributes, scrolls or erases leaves that
+// tracking wrong, and later frames draw in the wrong place or colors. Call
+// Invalidate after such a sequence to repaint from scratch.
+func WriteEscape(seq string) {
+	if !term.initialized || seq == "" {
+		return
+	}
+	if seq[0] != '' {
+		if term.debugW != nil {
+			fmt.Fprintf(term.debugW, "tinybox: WriteEscape dropped %q: not an escape sequence\n", seq)
 		}
+		return
 	}
+	writeOutput(seq)
+}
 
-	return Event{Type: EventMouse, Button: button, X: x, Y: y, Press: true}, nil
+// writeOutput sends seq now, or holds it for Flush under ManualFlush.
+func writeOutput(seq string) {
+	if term.flushMode == ManualFlush {
+		term.pending = append(term.pending, seq...)
+		return
+	}
+	writeString(seq)
 }
 
-func EnableMouse() {
-	if !term.mouseEnabled {
-		writeString(EnableMouseMode)
-		term.mouseEnabled = true
+// writeOutputBytes is writeOutput for a sequence built in a byte buffer.
+func writeOutputBytes(seq []byte) {
+	if term.flushMode == ManualFlush {
+		term.pending = append(term.pending, seq...)
+		return
 	}
+	syscall.Write(outFd, seq)
 }
 
-func DisableMouse() {
-	if term.mouseEnabled {
-		writeString(DisableMouseMode)
-		term.mouseEnabled = false
+// SetScrollRegion limits terminal scrolling to rows top through bottom
+// with DECSTBM, so that a line feed at the bottom row or CSI S/T (through
+// WriteEscape) scroll only that band, e.g. between a fixed header and
+// footer. This moves text on the terminal behind the cell buffer's back:
+// follow any such scrolling with Invalidate, or use ScrollRegion instead
+// to keep the buffer in step. Suspend and Close reset the region; Resume
+// puts it back.
+func SetScrollRegion(top, bottom int) {
+	top, bottom = max(top, 0), min(bottom, term.height-1)
+	if top >= bottom {
+		ResetScrollRegion()
+		return
 	}
+	term.scrollRegion = true
+	term.scrollTop, term.scrollBottom = top, bottom
+	writeOutput(fmt.Sprintf(SetScrollMargins, top+1, bottom+1))
 }
 
-func EnableBracketedPaste() {
-	if !term.pasteEnabled {
-		writeString(EnableBracketPaste)
-		term.pasteEnabled = true
+func ResetScrollRegion() {
+	term.scrollRegion = false
+	writeOutput(ResetScrollMargins)
+}
+
+// The soft cursor is drawn by Present, so it only blinks while the app keeps
+// presenting (e.g. from a PollEventTimeout loop).
+func SetSoftCursor(x, y int, style int) {
+	HideSoftCursor()
+	term.softCursor = true
+	term.softX = x + term.offsetX
+	term.softY = y + term.offsetY
+	term.softStyle = style
+	term.blinkStart = time.Now()
+}
+
+// SetSelection highlights the cells from startX, startY through endX, endY
+// in reading order, wrapping across rows, until ClearSelection. The ends may
+// be given in either order. Present draws the selection over whatever is in
+// the buffer, in reverse video or with the SetSelectionColor background.
+func SetSelection(startX, startY, endX, endY int) {
+	markSelection()
+	start := [2]int{startY + term.offsetY, startX + term.offsetX}
+	end := [2]int{endY + term.offsetY, endX + term.offsetX}
+	if end[0] < start[0] || end[0] == start[0] && end[1] < start[1] {
+		start, end = end, start
 	}
+	term.selection = true
+	term.selStart, term.selEnd = start, end
+	markSelection()
 }
 
-func DisableBracketedPaste() {
-	if term.pasteEnabled {
-		writeString(DisableBracketPaste)
-		term.pasteEnabled = false
+func ClearSelection() {
+	markSelection()
+	term.selection = false
+}
+
+// SetSelectionColor paints selected cells with background bg instead of
+// reversing them. A negative bg goes back to reverse video.
+func SetSelectionColor(bg int) {
+	term.selBg, term.selBgSet = bg, bg >= 0
+	markSelection()
+}
+
+// selectionSpan returns the selected columns [from, to) on row y.
+func selectionSpan(y int) (from, to int) {
+	if !term.selection || y < term.selStart[0] || y > term.selEnd[0] || y < 0 || y >= term.height {
+		return 0, 0
+	}
+	from, to = 0, term.width
+	if y == term.selStart[0] {
+		from = max(term.selStart[1], 0)
 	}
+	if y == term.selEnd[0] {
+		to = min(term.selEnd[1]+1, term.width)
+	}
+	return from, to
 }
 
-func SetColor(fg, bg int) {
-	term.currentFg = fg
-	term.currentBg = bg
+func markSelection() {
+	for y := max(term.selStart[0], 0); term.selection && y <= term.selEnd[0] && y < term.height; y++ {
+		from, to := selectionSpan(y)
+		for x := from; x < to; x++ {
+			term.buffer.Cells[y][x].Dirty = true
+		}
+		markRow(y)
+	}
 }
 
-func SetAttr(bold, italic, underline, reverse bool) {
-	term.currentBold = bold
-	term.currentItalic = italic
-	term.currentUnder = underline
-	term.currentRev = reverse
+// applySelection highlights the selected cells in place for Present and
+// returns their original contents for restoreSelection.
+func applySelection() []Cell {
+	saved := term.selSaved[:0]
+	if !term.selection || term.tooSmall {
+		return saved
+	}
+	for y := max(term.selStart[0], 0); y <= term.selEnd[0] && y < term.height; y++ {
+		from, to := selectionSpan(y)
+		for x := from; x < to; x++ {
+			c := &term.buffer.Cells[y][x]
+			saved = append(saved, *c)
+			if term.selBgSet {
+				c.Bg = term.selBg
+			} else {
+				c.Rev = !c.Rev
+			}
+		}
+	}
+	term.selSaved = saved
+	return saved
 }
 
-func ResetAttr() {
-	term.currentBold = false
-	term.currentItalic = false
-	term.currentUnder = false
-	term.currentRev = false
-	term.currentFg = 7
-	term.currentBg = 0
+func restoreSelection(saved []Cell) {
+	i := 0
+	for y := max(term.selStart[0], 0); i < len(saved) && y < term.height; y++ {
+		from, to := selectionSpan(y)
+		for x := from; x < to; x++ {
+			c := &term.buffer.Cells[y][x]
+			dirty := c.Dirty
+			*c = saved[i]
+			c.Dirty = dirty
+			i++
+		}
+	}
 }
 
-func Size() (width, height int) {
-	return term.width, term.height
+func HideSoftCursor() {
+	if term.softCursor && term.softX >= 0 && term.softX < term.width && term.softY >= 0 && term.softY < term.height {
+		term.buffer.Cells[term.softY][term.softX].Dirty = true
+		markRow(term.softY)
+	}
+	term.softCursor = false
+}
+
+func SetBlinkInterval(d time.Duration) {
+	term.blinkInterval = d
+}
+
+func softCursorLit() bool {
+	interval := term.blinkInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	return (time.Since(term.blinkStart)/interval)%2 == 0
+}
+
+func appendCursorMove(out []byte, row, col int) []byte {
+	if row < 1 {
+		row = 1
+	}
+	if col < 1 {
+		col = 1
+	}
+	out = append(out, '', '[')
+	out = appendInt(out, row)
+	out = append(out, ';')
+	out = appendInt(out, col)
+	return append(out, 'H')
+}
+
+func appendUnderline(out []byte, style UnderlineStyle) []byte {
+	if !term.extUnderline || style == UnderlineSingle || style > UnderlineDashed {
+		return append(out, seqSetUnderline...)
+	}
+	out = append(out, '', '[', '4', ':')
+	out = appendInt(out, int(style)+1)
+	return append(out, 'm')
+}
+
+func appendUnderlineColor(out []byte, value int) []byte {
+	out = append(out, '', '[', '5', '8')
+	return append(appendColorParams(out, value), 'm')
+}
+
+// colorRGB marks a color value built by RGBColor, with the components in
+// the low 24 bits. Anything below it is a palette index.
+const colorRGB = 1 << 24
+
+// RGBColor returns a color for SetColor and friends that is sent as 24-bit
+// color where the terminal supports it and as the nearest palette entry
+// elsewhere.
+func RGBColor(r, g, b int) int {
+	return colorRGB | clampColor(r)<<16 | clampColor(g)<<8 | clampColor(b)
+}
+
+func isRGBColor(value int) bool {
+	return value >= colorRGB && value < colorRGB<<1
+}
+
+func clampColor(value int) int {
+	if value < 0 {
+		return 0
+	} else if value > 255 {
+		return 255
+	}
+	return value
+}
+
+func appendSet256Color(out []byte, fg bool, value int) []byte {
+	out = append(out, '', '[')
+	if fg {
+		out = append(out, '3', '8')
+	} else {
+		out = append(out, '4', '8')
+	}
+	return append(appendColorParams(out, value), 'm')
+}
+
+// appendColorParams appends the ;5;n or ;2;r;g;b that follows 38, 48 or 58.
+func appendColorParams(out []byte, value int) []byte {
+	if isRGBColor(value) {
+		r, g, b := ColorToRGB(value)
+		if term.trueColor {
+			out = append(out, ';', '2', ';')
+			out = appendInt(out, r)
+			out = append(out, ';')
+			out = appendInt(out, g)
+			out = append(out, ';')
+			return appendInt(out, b)
+		}
+		value = RGBToColor(r, g, b)
+	}
+	out = append(out, ';', '5', ';')
+	return appendInt(out, clampColor(value))
+}
+
+func appendInt(out []byte, value int) []byte {
+	return strconv.AppendInt(out, int64(value), 10)
+}
+
+// DrawTextRightIn right-aligns text in the columns [x, x+width). Text that
+// is too wide loses its beginning.
+func DrawTextRightIn(x, y, width int, text string, fg, bg int) {
+	drawTextIn(x, y, width, x+width-StringWidth(text), text, fg, bg)
+}
+
+// DrawTextCenterIn centers text in the columns [x, x+width). Text that is
+// too wide loses its end.
+func DrawTextCenterIn(x, y, width int, text string, fg, bg int) {
+	drawTextIn(x, y, width, x+max((width-StringWidth(text))/2, 0), text, fg, bg)
+}
+
+// DrawTextTransposed draws text column-major: line i of text runs down
+// column x+i from row y, one grapheme per cell, so a block of words reads
+// top to bottom. Lines may differ in length. Wide characters spill into
+// the next column and are best avoided.
+func DrawTextTransposed(x, y int, text string, fg, bg int) {
+	for i, line := range strings.Split(text, "\n") {
+		row := y
+		for len(line) > 0 {
+			cluster, w, rest := nextGrapheme(line)
+			setCluster(x+i, row, cluster, w, fg, bg)
+			row++
+			line = rest
+		}
+	}
+}
+
+func drawTextIn(x, y, width, start int, text string, fg, bg int) {
+	if width <= 0 {
+		return
+	}
+	PushColor(fg, bg)
+	PushClip(x, y, width, 1)
+	PrintAt(start, y, text)
+	PopClip()
+	PopColor()
+}
+
+func DrawTextLeft(y int, text string, fg, bg int) {
+	for i, ch := range text {
+		SetCell(i, y, ch, fg, bg)
+	}
+}
+
+func DrawTextCenter(y int, text string, fg, bg int) {
+	startX := (term.width - len(text)) / 2
+	if startX < 0 {
+		startX = 0
+	}
+	for i, ch := range text {
+		SetCell(startX+i, y, ch, fg, bg)
+	}
+}
+
+func DrawTextRight(y int, text string, fg, bg int) {
+	startX := term.width - len(text)
+	if startX < 0 {
+		startX = 0
+	}
+	for i, ch := range text {
+		SetCell(startX+i, y, ch, fg, bg)
+	}
+}
+
+func ClearLine(y int) {
+	for x := 0; x < term.width; x++ {
+		SetCell(x, y, defaultCell.Ch, defaultCell.Fg, defaultCell.Bg)
+	}
+}
+
+type KeyMatcher struct {
+	Key Key
+	Ch  rune
+	Mod KeyMod
+}
+
+type KeyMap struct {
+	bindings map[KeyMatcher]string
+}
+
+var ctrlKeyRunes = map[Key]rune{
+	KeyCtrlA: 'a', KeyCtrlC: 'c', KeyCtrlD: 'd', KeyCtrlE: 'e',
+	KeyCtrlK: 'k', KeyCtrlU: 'u', KeyCtrlW: 'w',
+}
+
+func MatchKey(k Key, mod KeyMod) KeyMatcher {
+	return KeyMatcher{Key: k, Mod: mod}
+}
+
+func MatchRune(ch rune) KeyMatcher {
+	return KeyMatcher{Ch: ch}
+}
+
+func MatchCtrl(ch rune) KeyMatcher {
+	return KeyMatcher{Ch: unicode.ToLower(ch), Mod: ModCtrl}
+}
+
+// normalize folds the different spellings of a control key (KeyCtrlC, a raw
+// 0x03 rune, or 'c' with ModCtrl) into the last form.
+func (m KeyMatcher) normalize() KeyMatcher {
+	if ch, ok := ctrlKeyRunes[m.Key]; ok {
+		return KeyMatcher{Ch: ch, Mod: m.Mod | ModCtrl}
+	}
+	if m.Key == 0 && m.Ch >= 1 && m.Ch <= 26 {
+		return KeyMatcher{Ch: 'a' + m.Ch - 1, Mod: m.Mod | ModCtrl}
+	}
+	return m
+}
+
+func (km *KeyMap) Bind(action string, keys ...KeyMatcher) {
+	if km.bindings == nil {
+		km.bindings = make(map[KeyMatcher]string)
+	}
+	for _, k := range keys {
+		km.bindings[k.normalize()] = action
+	}
+}
+
+func (km *KeyMap) Lookup(evt Event) (action string, ok bool) {
+	if evt.Type != EventKey {
+		return "", false
+	}
+	action, ok = km.bindings[KeyMatcher{Key: evt.Key, Ch: evt.Ch, Mod: evt.Mod}.normalize()]
+	return action, ok
+}
+
+// ChordMatcher recognises multi-key sequences such as Ctrl+X Ctrl+S. Keys
+// fed more than Timeout apart (one second when zero) start a new sequence.
+type ChordMatcher struct {
+	Timeout  time.Duration
+	chords   map[string]string
+	prefixes map[string]bool
+	pending  string
+	last     time.Time
+}
+
+func chordKey(seq string, m KeyMatcher) string {
+	return seq + fmt.Sprintf("%d/%d/%d;", m.Key, m.Ch, m.Mod)
+}
+
+func (cm *ChordMatcher) Bind(action string, keys ...KeyMatcher) {
+	if cm.chords == nil {
+		cm.chords = make(map[string]string)
+		cm.prefixes = make(map[string]bool)
+	}
+	seq := ""
+	for i, k := range keys {
+		seq = chordKey(seq, k.normalize())
+		if i < len(keys)-1 {
+			cm.prefixes[seq] = true
+		}
+	}
+	cm.chords[seq] = action
+}
+
+// Feed adds evt to the sequence typed so far. It reports the bound action once
+// a full chord has been entered; a key that continues no chord resets the
+// sequence, starting over from that key.
+func (cm *ChordMatcher) Feed(evt Event) (action string, ok bool) {
+	if evt.Type != EventKey {
+		return "", false
+	}
+	timeout := cm.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	now := time.Now()
+	if cm.pending != "" && now.Sub(cm.last) > timeout {
+		cm.pending = ""
+	}
+	cm.last = now
+
+	k := KeyMatcher{Key: evt.Key, Ch: evt.Ch, Mod: evt.Mod}.normalize()
+	for _, seq := range []string{chordKey(cm.pending, k), chordKey("", k)} {
+		if action, ok := cm.chords[seq]; ok {
+			cm.pending = ""
+			return action, true
+		}
+		if cm.prefixes[seq] {
+			cm.pending = seq
+			return "", false
+		}
+	}
+	cm.pending = ""
+	return "", false
+}
+
+// Pending reports whether a chord has been started but not completed.
+func (cm *ChordMatcher) Pending() bool {
+	return cm.pending != ""
+}
+
+func (cm *ChordMatcher) Reset() {
+	cm.pending = ""
+}
+
+// GraphemeLeft returns the start of the grapheme cluster before pos, so
+// cursor movement steps over a wide character or an emoji sequence whole.
+func GraphemeLeft(text []rune, pos int) int {
+	pos = min(max(pos, 0), len(text))
+	start := 0
+	for i := 0; i < pos; {
+		start = i
+		i = GraphemeRight(text, i)
+	}
+	return start
+}
+
+func GraphemeRight(text []rune, pos int) int {
+	pos = min(max(pos, 0), len(text))
+	if pos == len(text) {
+		return pos
+	}
+	cluster, _, _ := nextGrapheme(string(text[pos:]))
+	return pos + max(utf8.RuneCountInString(cluster), 1)
+}
+
+// DeleteBackward removes the grapheme cluster before pos, returning the new
+// text and cursor position.
+func DeleteBackward(text []rune, pos int) ([]rune, int) {
+	start := GraphemeLeft(text, pos)
+	pos = min(max(pos, 0), len(text))
+	return append(text[:start:start], text[pos:]...), start
+}
+
+// DeleteForward removes the grapheme cluster at pos.
+func DeleteForward(text []rune, pos int) []rune {
+	pos = min(max(pos, 0), len(text))
+	end := GraphemeRight(text, pos)
+	return append(text[:pos:pos], text[end:]...)
+}
+
+// CursorColumn is the screen column of rune index pos in text.
+func CursorColumn(text []rune, pos int) int {
+	return StringWidth(string(text[:min(max(pos, 0), len(text))]))
+}
+
+// WordLeft returns where a word-left motion from pos lands: back over any
+// spaces, then to the start of the word before them. Words are split on
+// whitespace only, so punctuation belongs to the word it touches.
+func WordLeft(text []rune, pos int) int {
+	pos = min(max(pos, 0), len(text))
+	for pos > 0 && unicode.IsSpace(text[pos-1]) {
+		pos--
+	}
+	for pos > 0 && !unicode.IsSpace(text[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// WordRight is WordLeft going forward: over any spaces, then to the end of
+// the word after them.
+func WordRight(text []rune, pos int) int {
+	pos = min(max(pos, 0), len(text))
+	for pos < len(text) && unicode.IsSpace(text[pos]) {
+		pos++
+	}
+	for pos < len(text) && !unicode.IsSpace(text[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func SizeChanged() <-chan struct{} {
+	if term.sizeCh == nil {
+		term.sizeCh = make(chan struct{}, 1)
+	}
+	return term.sizeCh
+}
+
+func GetTerminalSize() (width, height int) {
+	return term.width, term.height
+}
+
+// SetEventFilter installs a function every event goes through before a poll
+// function returns it, queued ones included. Returning false drops the
+// event; the returned event replaces the original. nil removes the filter.
+func SetEventFilter(filter func(Event) (Event, bool)) {
+	term.eventFilter = filter
+}
+
+func filterEvent(evt Event) (Event, bool) {
+	// Counted here, as events are handed out, so queued presses count too.
+	if evt.Type == EventMouse {
+		evt = countClicks(evt)
+	}
+	if term.eventFilter == nil {
+		return evt, true
+	}
+	return term.eventFilter(evt)
+}
+
+func PollEvent() (Event, error) {
+	for {
+		evt, err := pollEvent()
+		if err != nil {
+			return evt, err
+		}
+		if evt, ok := filterEvent(evt); ok {
+			return evt, nil
+		}
+	}
+}
+
+// PollEventTimeout waits up to timeout for an event, counting time spent
+// on events the filter dropped.
+func PollEventTimeout(timeout time.Duration) (Event, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		evt, err := pollEventTimeout(max(time.Until(deadline), 0))
+		if err != nil {
+			return evt, err
+		}
+		if evt, ok := filterEvent(evt); ok {
+			return evt, nil
+		}
+	}
+}
+
+func PollEventNow() (Event, bool) {
+	for {
+		evt, ok := pollEventNow()
+		if !ok {
+			return evt, false
+		}
+		if evt, ok := filterEvent(evt); ok {
+			return evt, true
+		}
+	}
+}
+
+// readInput is the only place input is read. It takes the next chunk of a
+// replay if one is loaded, otherwise waits up to wait for the input fd (a
+// negative wait blocks) and copies what it reads to the recorder.
+func readInput(buf []byte, wait time.Duration) (int, error) {
+	if len(term.replay) > 0 {
+		data, ok := nextReplay(wait)
+		if !ok {
+			time.Sleep(wait)
+			return 0, ErrTimeout
+		}
+		n := copy(buf, data)
+		if n < len(data) {
+			term.replay = append([]inputRecord{{0, data[n:]}}, term.replay...)
+		}
+		return n, nil
+	}
+	if wait >= 0 {
+		fdSet := &syscall.FdSet{}
+		setFd(fdSet, inFd)
+		tv := syscall.NsecToTimeval(int64(wait))
+		n, err := selectRead(inFd, fdSet, &tv)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 {
+			return 0, ErrTimeout
+		}
+	}
+	n, err := syscall.Read(inFd, buf)
+	if n > 0 && term.recorder != nil {
+		now := time.Now()
+		fmt.Fprintf(term.recorder, "%d %s\n", now.Sub(term.recordLast).Milliseconds(), strconv.Quote(string(buf[:n])))
+		term.recordLast = now
+	}
+	return n, err
+}
+
+// RecordInput writes every chunk of raw input to w as a line holding the
+// milliseconds since the previous chunk and the bytes as a quoted Go string.
+// A nil w stops recording.
+func RecordInput(w io.Writer) {
+	term.recorder = w
+	term.recordLast = time.Now()
+}
+
+type inputRecord struct {
+	delay time.Duration
+	data  []byte
+}
+
+// ReplayInput loads a recording made by RecordInput. The poll functions
+// hand out its events, spaced as they were recorded or back to back if fast
+// is set, before going back to reading the terminal.
+func ReplayInput(r io.Reader, fast bool) error {
+	var records []inputRecord
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		ms, quoted, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		delay, err := strconv.Atoi(ms)
+		if err != nil {
+			return fmt.Errorf("tinybox: bad input record %q", sc.Text())
+		}
+		data, err := strconv.Unquote(quoted)
+		if err != nil || data == "" {
+			return fmt.Errorf("tinybox: bad input record %q", sc.Text())
+		}
+		records = append(records, inputRecord{time.Duration(delay) * time.Millisecond, []byte(data)})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	term.replay = records
+	term.replayLast = time.Now()
+	term.replayFast = fast
+	return nil
+}
+
+// nextReplay waits for the next recorded chunk to come due and returns it,
+// or gives up if that is more than wait away. A negative wait never gives up.
+func nextReplay(wait time.Duration) ([]byte, bool) {
+	rec := term.replay[0]
+	left := time.Until(term.replayLast.Add(rec.delay))
+	if term.replayFast {
+		left = 0
+	}
+	if wait >= 0 && left > wait {
+		return nil, false
+	}
+	if left > 0 {
+		time.Sleep(left)
+	}
+	term.replay = term.replay[1:]
+	term.replayLast = time.Now()
+	return rec.data, true
+}
+
+func pollEvent() (Event, error) {
+	if len(term.eventQueue) > 0 {
+		evt := term.eventQueue[0]
+		term.eventQueue = term.eventQueue[1:]
+		return evt, nil
+	}
+
+	if len(term.timers) > 0 {
+		for {
+			evt, err := pollEventTimeout(time.Hour)
+			if !errors.Is(err, ErrTimeout) {
+				return evt, err
+			}
+		}
+	}
+	return readEvent()
+}
+
+// readEvent blocks for the next replayed or typed input.
+func readEvent() (Event, error) {
+	if len(term.pendingInput) > 0 {
+		return decodeInput(nil)
+	}
+	buf := readBuffer()
+	n, err := readInput(buf, -1)
+	if err != nil {
+		return Event{}, err
+	}
+	if n == 0 {
+		return Event{}, fmt.Errorf("no input")
+	}
+
+	return decodeInput(buf[:n])
+}
+
+const (
+	defaultReadBufferSize = 1024
+	minReadBufferSize     = 64
+)
+
+// readBuffer is the buffer the poll functions read into. It's shared, so
+// nothing may keep a slice of it past decoding.
+func readBuffer() []byte {
+	if term.readBuf == nil {
+		term.readBuf = make([]byte, defaultReadBufferSize)
+	}
+	return term.readBuf
+}
+
+// SetReadBufferSize sets how many bytes one poll reads at most (1024 by
+// default, never less than 64). Big pastes arrive in fewer reads with a
+// larger buffer.
+func SetReadBufferSize(n int) {
+	term.readBuf = make([]byte, max(n, minReadBufferSize))
+}
+
+// decodeInput turns one read into events: the first is returned and the
+// rest are queued, so nothing after the first sequence is lost. Input held
+// back by an earlier PollEventNow goes in front of data.
+func decodeInput(data []byte) (Event, error) {
+	if len(term.pendingInput) > 0 {
+		data = append(term.pendingInput, data...)
+		term.pendingInput = nil
+	}
+	events := parseEvents(data)
+	if len(term.pendingInput) == 0 {
+		term.pendingSince = time.Time{}
+	}
+	if len(events) == 0 {
+		return Event{}, fmt.Errorf("no input")
+	}
+	term.eventQueue = append(term.eventQueue, events[1:]...)
+	return finishEvent(events[0]), nil
+}
+
+// parseEvents consumes data one sequence at a time. A sequence cut off at
+// the end of the buffer gets up to escDelay ms to complete before it is
+// reported as it stands. Inside PollEventNow it is held for the next poll
+// instead of waited for.
+func parseEvents(data []byte) []Event {
+	var events []Event
+	for len(data) > 0 {
+		if bytes.HasPrefix(data, seqPasteStart) {
+			if term.inputNoWait && !bytes.Contains(data, seqPasteEnd) && holdInput(data, time.Second) {
+				break
+			}
+			var evt Event
+			evt, data = readBracketedPaste(data[len(seqPasteStart):])
+			events = append(events, evt)
+			continue
+		}
+		if term.pasteHeuristic && looksLikePaste(data) {
+			events = append(events, readPasteBurst(data))
+			break
+		}
+		evt, n, err := parseInput(data)
+		// A lone ESC at the end may be the first byte of a sequence too.
+		incomplete := err == errIncomplete || len(data) == 1 && data[0] == 27
+		if term.inputNoWait && incomplete && holdInput(data, time.Duration(term.escDelay)*time.Millisecond) {
+			break
+		}
+		if err == errIncomplete {
+			if more := readMore(time.Duration(term.escDelay) * time.Millisecond); len(more) > 0 {
+				data = append(append([]byte(nil), data...), more...)
+				continue
+			}
+			evt, n, err = Event{Type: EventUnknown, Raw: append([]byte(nil), data...)}, len(data), nil
+			if len(data) == 2 && data[0] == 27 {
+				// Alt+[ or Alt+O rather than the start of a sequence
+				evt = altKey(data[1:])
+			}
+		}
+		if err != nil {
+			// A sequence the decoder rejects, such as an X10 mouse report
+			// past column 223, is passed on rather than silently dropped.
+			if term.debugW != nil {
+				fmt.Fprintf(term.debugW, "tinybox: %v: %q\n", err, data[:n])
+			}
+			evt = Event{Type: EventUnknown, Raw: append([]byte(nil), data[:n]...)}
+		}
+		data = data[n:]
+		events = append(events, evt)
+	}
+	return events
+}
+
+// holdInput keeps data, which ends in an incomplete sequence, for the next
+// poll. It reports false once the bytes have been held for limit, when they
+// should be decoded as they stand.
+func holdInput(data []byte, limit time.Duration) bool {
+	if term.pendingSince.IsZero() {
+		term.pendingSince = time.Now()
+	}
+	if time.Since(term.pendingSince) >= limit {
+		return false
+	}
+	term.pendingInput = append([]byte(nil), data...)
+	return true
+}
+
+// inputWait is how long a decoder may wait for more input: timeout
+// normally, not at all inside PollEventNow.
+func inputWait(timeout time.Duration) time.Duration {
+	if term.inputNoWait {
+		return 0
+	}
+	return timeout
+}
+
+func readMore(timeout time.Duration) []byte {
+	var buf [16]byte
+	n, err := readInput(buf[:], inputWait(timeout))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	return append([]byte(nil), buf[:n]...)
+}
+
+func readBracketedPaste(data []byte) (Event, []byte) {
+	text := append([]byte(nil), data...)
+	if !bytes.Contains(text, seqPasteEnd) {
+		more, _ := readReply(inputWait(time.Second), func(b []byte) bool {
+			return bytes.Contains(append(text, b...), seqPasteEnd)
+		})
+		text = append(text, more...)
+	}
+	var rest []byte
+	if end := bytes.Index(text, seqPasteEnd); end >= 0 {
+		text, rest = text[:end], text[end+len(seqPasteEnd):]
+	}
+	return Event{Type: EventPaste, Text: string(text)}, rest
+}
+
+// looksLikePaste guesses that a read with many plain characters and no
+// escape sequences came from a paste rather than typing.
+func looksLikePaste(data []byte) bool {
+	return len(data) >= pasteBurst && bytes.IndexByte(data, 27) < 0
+}
+
+func readPasteBurst(data []byte) Event {
+	text := append([]byte(nil), data...)
+	var buf [64]byte
+	for {
+		n, err := readInput(buf[:], inputWait(repeatWindow))
+		if err != nil || n <= 0 {
+			break
+		}
+		text = append(text, buf[:n]...)
+	}
+	return Event{Type: EventPaste, Text: string(text)}
+}
+
+func PasteSupported() bool {
+	if !term.pasteProbed {
+		value, ok := queryPrivateMode(2004)
+		term.pasteSupported = ok && value != 0 && value != 4
+		term.pasteProbed = true
+	}
+	return term.pasteSupported
+}
+
+func SetPasteHeuristic(enabled bool) {
+	term.pasteHeuristic = enabled
+}
+
+func finishEvent(evt Event) Event {
+	evt = coalesceRepeats(evt)
+	if evt.Type == EventKey {
+		term.blinkStart = time.Now()
+	}
+	return evt
+}
+
+// countClicks fills in Clicks on a button press: presses of the same button
+// on the same cell, each within clickWindow of the one before, count up.
+// Drag reports, which arrive as presses with no release in between, keep
+// the count of the press that started the drag.
+func countClicks(evt Event) Event {
+	if evt.Button >= MouseWheelUp {
+		return evt
+	}
+	if !evt.Press {
+		term.clickHeld = false
+		return evt
+	}
+	last := term.lastClick
+	if term.clickHeld {
+		evt.Clicks = last.Clicks
+		return evt
+	}
+	now := time.Now()
+	evt.Clicks = 1
+	if evt.Button == last.Button && evt.X == last.X && evt.Y == last.Y && now.Sub(term.lastClickAt) <= clickWindow {
+		evt.Clicks = last.Clicks + 1
+	}
+	term.lastClick, term.lastClickAt, term.clickHeld = evt, now, true
+	return evt
+}
+
+func coalesceRepeats(evt Event) Event {
+	if term.repeatMode != KeyRepeatCoalesce || evt.Type != EventKey {
+		return evt
+	}
+	same := func(next Event) bool {
+		return next.Type == EventKey && next.Key == evt.Key && next.Ch == evt.Ch && next.Mod == evt.Mod
+	}
+	for {
+		for len(term.eventQueue) > 0 && same(term.eventQueue[0]) {
+			term.eventQueue = term.eventQueue[1:]
+			evt.Repeat++
+		}
+		if len(term.eventQueue) > 0 {
+			return evt
+		}
+		more := readMore(repeatWindow)
+		if len(more) == 0 {
+			return evt
+		}
+		term.eventQueue = append(term.eventQueue, parseEvents(more)...)
+	}
+}
+
+// ReadLine shows prompt at the cursor position and reads a line of input
+// with basic editing: arrows (by word with Ctrl or Alt), Home/End, Backspace,
+// Delete, Ctrl-U and Ctrl-W. Escape or Ctrl-C give ErrCanceled. The row is
+// put back as it was before returning.
+func ReadLine(prompt string) (string, error) {
+	x, y := CursorPos()
+	sy := term.cursorY
+	if sy < 0 || sy >= term.height {
+		return "", fmt.Errorf("cursor off screen")
+	}
+	saved := append([]Cell(nil), term.buffer.Cells[sy]...)
+	visible := term.cursorVisible
+	SetCursorVisible(true)
+	defer func() {
+		if sy < term.height {
+			row := term.buffer.Cells[sy]
+			for i := 0; i < len(row) && i < len(saved); i++ {
+				row[i] = saved[i]
+				row[i].Dirty = true
+			}
+			markRow(sy)
+		}
+		SetCursor(x, y)
+		SetCursorVisible(visible)
+		Present()
+	}()
+
+	p := Prompt{Label: prompt}
+	width := term.width - term.cursorX
+	for {
+		p.Draw(x, y, width)
+		Present()
+
+		evt, err := PollEvent()
+		if err != nil {
+			return "", err
+		}
+		switch res := p.Feed(evt); res.State {
+		case PromptConfirmed:
+			return res.Value, nil
+		case PromptCancelled:
+			return "", ErrCanceled
+		}
+	}
+}
+
+// PromptResult is what Prompt.Feed reports after each event. Value is only
+// meaningful once State is PromptConfirmed.
+type PromptResult struct {
+	State PromptState
+	Value string
+}
+
+// Prompt is a single-line input that is driven by feeding it events, for
+// apps that run their own event loop. It has the same editing keys as
+// ReadLine.
+type Prompt struct {
+	Label string
+	text  []rune
+	pos   int
+}
+
+// Feed applies evt to the prompt. Enter confirms with the current text,
+// Escape or Ctrl-C cancel; everything else leaves it pending.
+func (p *Prompt) Feed(evt Event) PromptResult {
+	pending := PromptResult{State: PromptPending}
+	if evt.Type == EventPaste {
+		p.insert([]rune(strings.ReplaceAll(evt.Text, "\n", " ")))
+		return pending
+	}
+	if evt.Type != EventKey {
+		return pending
+	}
+	switch evt.Key {
+	case KeyEnter:
+		return PromptResult{State: PromptConfirmed, Value: string(p.text)}
+	case KeyEscape, KeyCtrlC:
+		return PromptResult{State: PromptCancelled}
+	case KeyBackspace:
+		p.text, p.pos = DeleteBackward(p.text, p.pos)
+	case KeyDelete:
+		p.text = DeleteForward(p.text, p.pos)
+	case KeyArrowLeft:
+		if evt.Mod&(ModCtrl|ModAlt) != 0 {
+			p.pos = WordLeft(p.text, p.pos)
+		} else {
+			p.pos = GraphemeLeft(p.text, p.pos)
+		}
+	case KeyArrowRight:
+		if evt.Mod&(ModCtrl|ModAlt) != 0 {
+			p.pos = WordRight(p.text, p.pos)
+		} else {
+			p.pos = GraphemeRight(p.text, p.pos)
+		}
+	case KeyCtrlW:
+		start := WordLeft(p.text, p.pos)
+		p.text = append(p.text[:start], p.text[p.pos:]...)
+		p.pos = start
+	case KeyHome, KeyCtrlA:
+		p.pos = 0
+	case KeyEnd, KeyCtrlE:
+		p.pos = len(p.text)
+	case KeyCtrlU:
+		p.text, p.pos = p.text[p.pos:], 0
+	default:
+		if evt.Key == 0 && evt.Ch >= 0x20 && evt.Mod&(ModCtrl|ModAlt) == 0 {
+			p.insert([]rune{evt.Ch})
+		}
+	}
+	return pending
+}
+
+func (p *Prompt) insert(rs []rune) {
+	p.text = append(p.text[:p.pos], append(rs, p.text[p.pos:]...)...)
+	p.pos += len(rs)
+}
+
+// Value returns the text typed so far.
+func (p *Prompt) Value() string {
+	return string(p.text)
+}
+
+// SetValue replaces the text and puts the cursor at its end.
+func (p *Prompt) SetValue(s string) {
+	p.text = []rune(s)
+	p.pos = len(p.text)
+}
+
+// Draw clears width cells at x, y, draws the label and text there and
+// moves the cursor to the edit position.
+func (p *Prompt) Draw(x, y, width int) {
+	ClearRect(x, y, width, 1)
+	PrintAt(x, y, p.Label)
+	start := x + StringWidth(p.Label)
+	PrintAt(start, y, string(p.text))
+	SetCursor(start+CursorColumn(p.text, p.pos), y)
+}
+
+func SetKeyRepeatMode(mode KeyRepeatMode) {
+	term.repeatMode = mode
+}
+
+func pollEventTimeout(timeout time.Duration) (Event, error) {
+	if len(term.eventQueue) > 0 {
+		evt := term.eventQueue[0]
+		term.eventQueue = term.eventQueue[1:]
+		return evt, nil
+	}
+
+	if len(term.pendingInput) > 0 {
+		return decodeInput(nil)
+	}
+
+	// Waits are cut short at the next timer so it fires on time.
+	deadline := time.Now().Add(timeout)
+	for {
+		if evt, ok := dueTimer(); ok {
+			return evt, nil
+		}
+		wait := max(time.Until(deadline), 0)
+		if next, ok := nextTimer(); ok && next < wait {
+			wait = next
+		}
+
+		buf := readBuffer()
+		n, err := readInput(buf, wait)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil {
+			if n == 0 {
+				return Event{}, fmt.Errorf("no input")
+			}
+			return decodeInput(buf[:n])
+		}
+		if !errors.Is(err, ErrTimeout) {
+			return Event{}, err
+		}
+
+		if !time.Now().Before(deadline) {
+			if evt, ok := dueTimer(); ok {
+				return evt, nil
+			}
+			return Event{}, ErrTimeout
+		}
+	}
+}
+
+type timer struct {
+	id       int
+	interval time.Duration
+	next     time.Time
+}
+
+// AddTimer starts a timer that delivers an EventTimer carrying the returned
+// id through the poll functions every interval, until RemoveTimer. Ticks
+// missed while the app wasn't polling are dropped rather than delivered in
+// a burst.
+func AddTimer(interval time.Duration) int {
+	interval = max(interval, time.Millisecond)
+	term.nextTimerID++
+	term.timers = append(term.timers, timer{
+		id:       term.nextTimerID,
+		interval: interval,
+		next:     time.Now().Add(interval),
+	})
+	return term.nextTimerID
+}
+
+func RemoveTimer(id int) {
+	for i, t := range term.timers {
+		if t.id == id {
+			term.timers = append(term.timers[:i], term.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// dueTimer returns the event for the most overdue timer, if any, and
+// schedules its next tick.
+func dueTimer() (Event, bool) {
+	now := time.Now()
+	due := -1
+	for i, t := range term.timers {
+		if !t.next.After(now) && (due < 0 || t.next.Before(term.timers[due].next)) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return Event{}, false
+	}
+	t := &term.timers[due]
+	t.next = t.next.Add(t.interval)
+	if !t.next.After(now) {
+		t.next = now.Add(t.interval)
+	}
+	return Event{Type: EventTimer, Timer: t.id}, true
+}
+
+// nextTimer returns how long until the next timer is due.
+func nextTimer() (time.Duration, bool) {
+	if len(term.timers) == 0 {
+		return 0, false
+	}
+	next := term.timers[0].next
+	for _, t := range term.timers[1:] {
+		if t.next.Before(next) {
+			next = t.next
+		}
+	}
+	return max(time.Until(next), 0), true
+}
+
+func pollEventNow() (Event, bool) {
+	if len(term.eventQueue) > 0 {
+		evt := term.eventQueue[0]
+		term.eventQueue = term.eventQueue[1:]
+		return evt, true
+	}
+
+	if evt, ok := dueTimer(); ok {
+		return evt, true
+	}
+
+	// Nothing below may wait: an incomplete sequence is kept for the next
+	// poll rather than given escDelay to finish.
+	buf := readBuffer()
+	n, err := readInput(buf, 0)
+	if err != nil || n <= 0 {
+		if len(term.pendingInput) == 0 {
+			return Event{}, false
+		}
+		n = 0
+	}
+	term.inputNoWait = true
+	evt, err := decodeInput(buf[:n])
+	term.inputNoWait = false
+	if err != nil {
+		return Event{}, false
+	}
+	return evt, true
+}
+
+func parseSGRMouse(buf []byte) (Event, error) {
+	// SGR format: \033[<button;x;y[Mm]
+	if len(buf) < 9 || buf[0] != 27 || buf[1] != '[' || buf[2] != '<' {
+		return Event{}, fmt.Errorf("not SGR mouse format")
+	}
+
+	i := 3
+	button, next, ok := parseDecimal(buf, i)
+	if !ok {
+		return Event{}, fmt.Errorf("invalid SGR mouse button")
+	}
+	i = next
+	if i >= len(buf) || buf[i] != ';' {
+		return Event{}, fmt.Errorf("invalid SGR mouse separator")
+	}
+	i++
+
+	x, next, ok := parseDecimal(buf, i)
+	if !ok {
+		return Event{}, fmt.Errorf("invalid SGR mouse x")
+	}
+	i = next
+	if i >= len(buf) || buf[i] != ';' {
+		return Event{}, fmt.Errorf("invalid SGR mouse separator")
+	}
+	i++
+
+	y, next, ok := parseDecimal(buf, i)
+	if !ok {
+		return Event{}, fmt.Errorf("invalid SGR mouse y")
+	}
+	i = next
+	if i >= len(buf) {
+		return Event{}, fmt.Errorf("no SGR terminator found")
+	}
+
+	press := false
+	switch buf[i] {
+	case 'M':
+		press = true
+	case 'm':
+		press = false
+	default:
+		return Event{}, fmt.Errorf("invalid SGR mouse terminator")
+	}
+
+	var mouseButton MouseButton
+	switch button & 3 {
+	case 0:
+		mouseButton = MouseLeft
+	case 1:
+		mouseButton = MouseMiddle
+	case 2:
+		mouseButton = MouseRight
+	}
+
+	if button >= 64 {
+		if button&1 != 0 {
+			mouseButton = MouseWheelDown
+		} else {
+			mouseButton = MouseWheelUp
+		}
+	}
+
+	return Event{Type: EventMouse, Button: mouseButton, X: x - 1, Y: y - 1, Press: press}, nil
+}
+
+func parseDecimal(buf []byte, idx int) (value, next int, ok bool) {
+	if idx >= len(buf) {
+		return 0, idx, false
+	}
+	start := idx
+	val := 0
+	for idx < len(buf) {
+		b := buf[idx]
+		if b < '0' || b > '9' {
+			break
+		}
+		val = val*10 + int(b-'0')
+		idx++
+	}
+	if idx == start {
+		return 0, idx, false
+	}
+	return val, idx, true
+}
+
+var errIncomplete = errors.New("incomplete input sequence")
+
+// parseInput decodes the event at the start of buf and reports how many
+// bytes it used. errIncomplete means buf ends partway through a sequence.
+func parseInput(buf []byte) (Event, int, error) {
+	if len(buf) == 0 {
+		return Event{}, 0, fmt.Errorf("no input")
+	}
+
+	ch := buf[0]
+	if ch == 27 {
+		if len(buf) == 1 || buf[1] == 27 {
+			return Event{Type: EventKey, Key: KeyEscape}, 1, nil
+		}
+		n := escapeLength(buf)
+		if n == 0 {
+			return Event{}, 0, errIncomplete
+		}
+		evt, err := parseSequence(buf[:n])
+		return evt, n, err
+	}
+	if ch >= utf8.RuneSelf {
+		if !utf8.FullRune(buf) {
+			return Event{}, 0, errIncomplete
+		}
+		r, size := utf8.DecodeRune(buf)
+		return Event{Type: EventKey, Ch: r}, size, nil
+	}
+	evt, err := parseSequence(buf[:1])
+	return evt, 1, err
+}
+
+// altKey decodes the key after an ESC prefix and adds ModAlt to it.
+func altKey(key []byte) Event {
+	evt, n, err := parseInput(key)
+	if err != nil || n != len(key) {
+		return Event{Type: EventUnknown, Raw: append([]byte{27}, key...)}
+	}
+	evt.Mod |= ModAlt
+	return evt
+}
+
+// escapeLength returns the length of the escape sequence at the start of
+// buf, or 0 if buf ends before the sequence does.
+func escapeLength(buf []byte) int {
+	switch buf[1] {
+	case '[':
+		if len(buf) >= 3 && buf[2] == 'M' {
+			if len(buf) < 6 {
+				return 0
+			}
+			return 6
+		}
+		i := 2
+		for i < len(buf) && buf[i] >= 0x20 && buf[i] <= 0x3f {
+			i++
+		}
+		if i >= len(buf) {
+			return 0
+		}
+		return i + 1
+	case 'O':
+		if len(buf) < 3 {
+			return 0
+		}
+		return 3
+	case ']':
+		for i := 2; i < len(buf); i++ {
+			if buf[i] == 7 {
+				return i + 1
+			}
+			if buf[i] == 27 && i+1 < len(buf) && buf[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return 0
+	}
+	if buf[1] >= utf8.RuneSelf {
+		if !utf8.FullRune(buf[1:]) {
+			return 0
+		}
+		_, size := utf8.DecodeRune(buf[1:])
+		return 1 + size
+	}
+	return 2
+}
+
+func parseSequence(buf []byte) (Event, error) {
+	ch := buf[0]
+
+	if ch == 27 { // ESC
+		if len(buf) == 1 {
+			return Event{Type: EventKey, Key: KeyEscape}, nil
+		}
+		if buf[1] != '[' && buf[1] != 'O' && buf[1] != ']' {
+			// Alt+key, sent as ESC followed by the key
+			return altKey(buf[1:]), nil
+		}
+		if len(buf) == 3 && buf[1] == 'O' {
+			// SS3: F1-F4, and cursor keys in application mode
+			switch buf[2] {
+			case 'P', 'Q', 'R', 'S':
+				return Event{Type: EventKey, Key: KeyF1 + Key(buf[2]-'P')}, nil
+			case 'A':
+				return Event{Type: EventKey, Key: KeyArrowUp}, nil
+			case 'B':
+				return Event{Type: EventKey, Key: KeyArrowDown}, nil
+			case 'C':
+				return Event{Type: EventKey, Key: KeyArrowRight}, nil
+			case 'D':
+				return Event{Type: EventKey, Key: KeyArrowLeft}, nil
+			case 'H':
+				return Event{Type: EventKey, Key: KeyHome}, nil
+			case 'F':
+				return Event{Type: EventKey, Key: KeyEnd}, nil
+			}
+		}
+		if len(buf) >= 6 && buf[1] == '[' && buf[2] == '<' {
+			if evt, err := parseSGRMouse(buf); err == nil {
+				return evt, nil
+			}
+		}
+		if len(buf) >= 8 && buf[1] == '[' && buf[2] >= '0' && buf[2] <= '9' && buf[len(buf)-1] == 'M' {
+			if evt, err := parseURXVTMouse(buf); err == nil {
+				return evt, nil
+			}
+		}
+		if len(buf) >= 6 && buf[1] == '[' && buf[2] == '1' && buf[3] == ';' && buf[4] >= '2' && buf[4] <= '8' {
+			// xterm modifier parameter: 1 + (shift | alt<<1 | ctrl<<2)
+			mod := KeyMod(buf[4] - '1')
+			switch buf[5] {
+			case 'A':
+				return Event{Type: EventKey, Key: KeyArrowUp, Mod: mod}, nil
+			case 'B':
+				return Event{Type: EventKey, Key: KeyArrowDown, Mod: mod}, nil
+			case 'C':
+				return Event{Type: EventKey, Key: KeyArrowRight, Mod: mod}, nil
+			case 'D':
+				return Event{Type: EventKey, Key: KeyArrowLeft, Mod: mod}, nil
+			case 'H':
+				return Event{Type: EventKey, Key: KeyHome, Mod: mod}, nil
+			case 'F':
+				return Event{Type: EventKey, Key: KeyEnd, Mod: mod}, nil
+			}
+		}
+		if len(buf) >= 3 && buf[1] == '[' {
+			switch buf[2] {
+			case 'A':
+				return Event{Type: EventKey, Key: KeyArrowUp}, nil
+			case 'B':
+				return Event{Type: EventKey, Key: KeyArrowDown}, nil
+			case 'C':
+				return Event{Type: EventKey, Key: KeyArrowRight}, nil
+			case 'D':
+				return Event{Type: EventKey, Key: KeyArrowLeft}, nil
+			case 'I':
+				return Event{Type: EventFocus, Focused: true}, nil
+			case 'O':
+				return Event{Type: EventFocus, Focused: false}, nil
+			case 'H':
+				return Event{Type: EventKey, Key: KeyHome}, nil
+			case 'F':
+				return Event{Type: EventKey, Key: KeyEnd}, nil
+			case '1':
+				if len(buf) >= 4 && buf[3] == '~' {
+					return Event{Type: EventKey, Key: KeyHome}, nil
+				}
+			case '3':
+				if len(buf) >= 4 && buf[3] == '~' {
+					return Event{Type: EventKey, Key: KeyDelete}, nil
+				}
+			case '5':
+				if len(buf) >= 4 && buf[3] == '~' {
+					return Event{Type: EventKey, Key: KeyPageUp}, nil
+				}
+			case '6':
+				if len(buf) >= 4 && buf[3] == '~' {
+					return Event{Type: EventKey, Key: KeyPageDown}, nil
+				}
+			case 'M':
+				if len(buf) >= 6 {
+					return parseMouseEvent(buf[3:6])
+				}
+			}
+			if len(buf) >= 5 && buf[2] == '1' {
+				switch buf[3] {
+				case '1', '2', '3', '4', '5':
+					if buf[4] == '~' {
+						return Event{Type: EventKey, Key: Key(int(KeyF1) + int(buf[3]-'1'))}, nil
+					}
+				}
+			}
+		}
+		return Event{Type: EventUnknown, Raw: append([]byte(nil), buf...)}, nil
+	}
+
+	switch ch {
+	case 1:
+		return Event{Type: EventKey, Key: KeyCtrlA}, nil
+	case 3:
+		return Event{Type: EventKey, Key: KeyCtrlC}, nil
+	case 4:
+		return Event{Type: EventKey, Key: KeyCtrlD}, nil
+	case 5:
+		return Event{Type: EventKey, Key: KeyCtrlE}, nil
+	case 9:
+		return Event{Type: EventKey, Key: KeyTab}, nil
+	case 11:
+		return Event{Type: EventKey, Key: KeyCtrlK}, nil
+	case 10, 13:
+		// With ICRNL off Enter normally arrives as CR, but some terminals,
+		// tmux setups and unbracketed pastes send LF. Ctrl-J is LF as well.
+		return Event{Type: EventKey, Key: KeyEnter}, nil
+	case 21:
+		return Event{Type: EventKey, Key: KeyCtrlU}, nil
+	case 23:
+		return Event{Type: EventKey, Key: KeyCtrlW}, nil
+	case 127:
+		return Event{Type: EventKey, Key: KeyBackspace}, nil
+	default:
+		return Event{Type: EventKey, Ch: rune(ch)}, nil
+	}
+}
+
+// The X10 encoding (ESC[M followed by three bytes) can't represent a column
+// or row past 223; xterm sends a zero byte in that case. EnableMouse asks for
+// SGR (1006) and urxvt (1015) reports, which have no such limit, so this path
+// only matters on terminals that support neither. parseEvents reports a
+// position it can't decode as EventUnknown.
+func parseMouseEvent(buf []byte) (Event, error) {
+	if len(buf) < 3 {
+		return Event{}, fmt.Errorf("incomplete mouse event")
+	}
+	if buf[0] < 32 || buf[1] <= 32 || buf[2] <= 32 {
+		return Event{}, fmt.Errorf("mouse position out of X10 range")
+	}
+
+	return decodeLegacyMouse(int(buf[0])-32, int(buf[1])-33, int(buf[2])-33), nil
+}
+
+func parseURXVTMouse(buf []byte) (Event, error) {
+	// urxvt format: \033[button;x;yM, button offset by 32 like X10
+	i := 2
+	var vals [3]int
+	for k := range vals {
+		v, next, ok := parseDecimal(buf, i)
+		if !ok {
+			return Event{}, fmt.Errorf("invalid urxvt mouse field")
+		}
+		vals[k] = v
+		i = next
+		if k < 2 {
+			if i >= len(buf) || buf[i] != ';' {
+				return Event{}, fmt.Errorf("invalid urxvt mouse separator")
+			}
+			i++
+		}
+	}
+	if i != len(buf)-1 || buf[i] != 'M' || vals[0] < 32 || vals[1] < 1 || vals[2] < 1 {
+		return Event{}, fmt.Errorf("invalid urxvt mouse event")
+	}
+
+	return decodeLegacyMouse(vals[0]-32, vals[1]-1, vals[2]-1), nil
+}
+
+func decodeLegacyMouse(b, x, y int) Event {
+	var button MouseButton
+	switch b & 3 {
+	case 0:
+		button = MouseLeft
+	case 1:
+		button = MouseMiddle
+	case 2:
+		button = MouseRight
+	}
+
+	if b&64 != 0 {
+		if b&1 != 0 {
+			button = MouseWheelDown
+		} else {
+			button = MouseWheelUp
+		}
+	}
+
+	press := b&64 != 0 || b&3 != 3
+	return Event{Type: EventMouse, Button: button, X: x, Y: y, Press: press}
+}
+
+func EnableMouse() {
+	if !term.mouseEnabled {
+		writeOutput(EnableMouseMode)
+		term.mouseEnabled = true
+	}
+}
+
+func DisableMouse() {
+	if term.mouseEnabled {
+		writeString(DisableMouseMode)
+		term.mouseEnabled = false
+	}
+}
+
+func EnableBracketedPaste() {
+	if !term.pasteEnabled {
+		writeString(EnableBracketPaste)
+		term.pasteEnabled = true
+	}
+}
+
+func DisableBracketedPaste() {
+	if term.pasteEnabled {
+		writeString(DisableBracketPaste)
+		term.pasteEnabled = false
+	}
+}
+
+func EnableFocusReporting() {
+	if !term.focusEnabled {
+		writeString(EnableFocusMode)
+		term.focusEnabled = true
+	}
+}
+
+func DisableFocusReporting() {
+	if term.focusEnabled {
+		writeString(DisableFocusMode)
+		term.focusEnabled = false
+	}
+}
+
+func SetColor(fg, bg int) {
+	term.currentFg = fg
+	term.currentBg = bg
+}
+
+func SetStyle(s Style) {
+	term.currentFg = s.Fg
+	term.currentBg = s.Bg
+	term.currentBold = s.Bold
+	term.currentItalic = s.Italic
+	term.currentUnder = s.Under
+	term.currentRev = s.Rev
+	term.currentStrike = s.Strike
+}
+
+func CurrentStyle() Style {
+	return Style{
+		Fg:     term.currentFg,
+		Bg:     term.currentBg,
+		Bold:   term.currentBold,
+		Italic: term.currentItalic,
+		Under:  term.currentUnder,
+		Rev:    term.currentRev,
+		Strike: term.currentStrike,
+	}
+}
+
+func SetAttr(bold, italic, underline, reverse bool) {
+	term.currentBold = bold
+	term.currentItalic = italic
+	term.currentUnder = underline
+	term.currentRev = reverse
+}
+
+// Bold, Italic, Underline, Reverse and Strike switch a single attribute and
+// leave the others alone. (The SetBold-style names are taken by the raw
+// escape sequence constants.)
+func Bold(on bool) {
+	term.currentBold = on
+}
+
+func Italic(on bool) {
+	term.currentItalic = on
+}
+
+func Underline(on bool) {
+	term.currentUnder = on
+}
+
+func Reverse(on bool) {
+	term.currentRev = on
+}
+
+func Strike(on bool) {
+	term.currentStrike = on
+}
+
+func ResetAttr() {
+	term.currentBold = false
+	term.currentItalic = false
+	term.currentUnder = false
+	term.currentRev = false
+	term.currentStrike = false
+	term.currentUStyle = UnderlineSingle
+	term.currentUColor = -1
+	term.currentFg = defaultCell.Fg
+	term.currentBg = defaultCell.Bg
+}
+
+func SetUnderlineStyle(style UnderlineStyle) {
+	term.currentUStyle = style
+}
+
+func SetUnderlineColor(color int) {
+	term.currentUColor = color
+}
+
+func SetExtendedUnderline(enabled bool) {
+	term.extUnderline = enabled
+}
+
+func HasExtendedUnderline() bool {
+	return term.extUnderline
+}
+
+func detectTrueColor() bool {
+	switch os.Getenv("COLORTERM") {
+	case "truecolor", "24bit":
+		return true
+	}
+	return false
+}
+
+// SetTrueColor overrides the COLORTERM check deciding whether RGBColor
+// values are sent as 24-bit color or matched to the palette.
+func SetTrueColor(enabled bool) {
+	term.trueColor = enabled
+	Invalidate()
+}
+
+func detectExtendedUnderline() bool {
+	if os.Getenv("KITTY_WINDOW_ID") != "" || os.Getenv("WEZTERM_EXECUTABLE") != "" {
+		return true
+	}
+	if vte, _ := strconv.Atoi(os.Getenv("VTE_VERSION")); vte >= 5102 {
+		return true
+	}
+	switch os.Getenv("TERM") {
+	case "xterm-kitty", "wezterm", "foot", "foot-extra", "contour":
+		return true
+	}
+	return false
+}
+
+// SetTerminalBackground and SetTerminalForeground are opt-in: tinybox never
+// touches the terminal's own default colors unless the app calls one of them
+// explicitly. Close puts back whatever the terminal reported before the first
+// change; terminals that don't answer the query are left with the new colors.
+func SetTerminalBackground(r, g, b int) {
+	setOSCColor("11", r, g, b)
+}
+
+// QueryBackgroundColor asks the terminal for its background color. ok is
+// false when the terminal doesn't answer within the timeout.
+func QueryBackgroundColor() (r, g, b int, ok bool) {
+	spec, ok := queryOSCColor("11")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return parseRGBSpec(spec)
+}
+
+// IsDarkBackground reports whether the terminal background is dark, going
+// by its luminance. Terminals that don't say are assumed to be dark.
+func IsDarkBackground() bool {
+	r, g, b, ok := QueryBackgroundColor()
+	if !ok {
+		return true
+	}
+	return 0.2126*float64(r)+0.7152*float64(g)+0.0722*float64(b) < 128
+}
+
+// SetTerminalForeground is the foreground counterpart of
+// SetTerminalBackground; Close restores it the same way.
+func SetTerminalForeground(r, g, b int) {
+	setOSCColor("10", r, g, b)
+}
+
+func GetPaletteColor(index int) (r, g, b int, ok bool) {
+	if index < 0 || index > 255 {
+		return 0, 0, 0, false
+	}
+	spec, ok := queryOSCColor("4;" + strconv.Itoa(index))
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return parseRGBSpec(spec)
+}
+
+func SetPaletteColor(index, r, g, b int) {
+	if index < 0 || index > 255 {
+		return
+	}
+	setOSCColor("4;"+strconv.Itoa(index), r, g, b)
+}
+
+func Size() (width, height int) {
+	return term.width, term.height
+}
+
+// SetHideDuringRender controls whether Present hides a visible cursor
+// while it draws. It's on by default.
+func SetHideDuringRender(enabled bool) {
+	term.showDuringRender = !enabled
+}
+
+func SetSyncMode(enabled bool) {
+	if enabled && !term.syncProbed {
+		value, ok := queryPrivateMode(2026)
+		term.syncSupported = !ok || (value != 0 && value != 4)
+		term.syncProbed = true
+	}
+	term.syncOutput = enabled && term.syncSupported
+}
+
+// SetRepeatOutput lets Present send runs of identical cells as a single
+// character followed by REP (ESC[nb). The first time it's enabled tinybox
+// checks that the terminal actually repeats, since REP is not universal; if
+// it doesn't, this stays off.
+func SetRepeatOutput(enabled bool) {
+	if enabled && !term.repProbed && term.initialized {
+		term.repSupported = probeRepeat()
+		term.repProbed = true
+	}
+	term.repOutput = enabled && term.repSupported
+}
+
+// probeRepeat writes a space and repeats it once in the top left corner,
+// then asks where the cursor ended up. The two cells touched are repainted
+// by the next Present.
+func probeRepeat() bool {
+	row, col, err := queryCursorReport(ESC+"[1;1H "+ESC+"[1b"+QueryCursorPos, 200*time.Millisecond)
+	for x := 0; x < 2 && x < term.width && term.height > 0; x++ {
+		term.backBuffer.Cells[0][x] = Cell{Ch: -1, Fg: -1, Bg: -1, UnderColor: -1}
+		term.buffer.Cells[0][x].Dirty = true
+		markRow(0)
+	}
+	return err == nil && row == 1 && col == 3
+}
+
+// SetRenderMode picks how Present works out what to send. The default,
+// RenderIncremental, compares against what was last drawn and sends only
+// changes. RenderFull skips that and sends the whole buffer every time,
+// which is cheaper for apps that repaint nearly every cell each frame.
+func SetRenderMode(mode RenderMode) {
+	term.renderMode = mode
+}
+
+func SetFlushMode(mode FlushMode) {
+	if mode == AutoFlush && len(term.pending) > 0 {
+		syscall.Write(outFd, term.pending)
+		term.pending = term.pending[:0]
+	}
+	term.flushMode = mode
+}
+
+func Flush() {
+	if term.flushMode == ManualFlush {
+		if len(term.pending) > 0 {
+			syscall.Write(outFd, term.pending)
+			term.pending = term.pending[:0]
+		}
+		return
+	}
+	Present()
+}
+
+func Fill(x, y, w, h int, ch rune) {
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			SetCell(x+dx, y+dy, ch, term.currentFg, term.currentBg)
+		}
+	}
+}
+
+func PrintAt(x, y int, text string) {
+	for len(text) > 0 {
+		cluster, w, rest := nextGrapheme(text)
+		setCluster(x, y, cluster, w, term.currentFg, term.currentBg)
+		x += w
+		text = rest
+	}
+}
+
+func setCluster(x, y int, cluster string, w int, fg, bg int) {
+	x += term.offsetX
+	y += term.offsetY
+	if !inClip(x, y) || !inClip(x+w-1, y) {
+		checkBounds(x+max(w-1, 0), y)
+		return
+	}
+	ch, n := utf8.DecodeRuneInString(cluster)
+	c := styledCell(ch, fg, bg)
+	if n < len(cluster) {
+		c.Seq = cluster
+	}
+	putCell(x, y, c)
+	cont := styledCell(0, fg, bg)
+	cont.Cont = true
+	for i := 1; i < w; i++ {
+		putCell(x+i, y, cont)
+	}
+}
+
+func RuneWidth(r rune) int {
+	switch {
+	case r == 0:
+		return 0
+	case r < 0x20 || (r >= 0x7f && r < 0xa0):
+		return 0
+	case r == 0x200d || (r >= 0xfe00 && r <= 0xfe0f) || (r >= 0x1f3fb && r <= 0x1f3ff):
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0x303e,
+		r >= 0x3041 && r <= 0x33ff,
+		r >= 0x3400 && r <= 0x4dbf,
+		r >= 0x4e00 && r <= 0x9fff,
+		r >= 0xa000 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f680 && r <= 0x1f6ff,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x1fa70 && r <= 0x1faff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+func StringWidth(s string) int {
+	width := 0
+	for len(s) > 0 {
+		_, w, rest := nextGrapheme(s)
+		width += w
+		s = rest
+	}
+	return width
+}
+
+// DrawText wraps text to rect's width, draws as many lines as fit, and
+// returns how many lines didn't.
+func DrawText(rect Rect, text string, s Style, align Align) int {
+	prev := CurrentStyle()
+	SetStyle(s)
+	PushClip(rect.X, rect.Y, rect.W, rect.H)
+	lines := wrapText(text, rect.W)
+	for i := 0; i < len(lines) && i < rect.H; i++ {
+		x := rect.X
+		switch align {
+		case AlignCenter:
+			x += max((rect.W-StringWidth(lines[i]))/2, 0)
+		case AlignRight:
+			x += max(rect.W-StringWidth(lines[i]), 0)
+		}
+		PrintAt(x, rect.Y+i, lines[i])
+	}
+	PopClip()
+	SetStyle(prev)
+	return max(len(lines)-max(rect.H, 0), 0)
+}
+
+func MeasureText(text string, maxWidth int) (w, h int) {
+	lines := wrapText(text, maxWidth)
+	for _, line := range lines {
+		w = max(w, StringWidth(line))
+	}
+	return w, len(lines)
+}
+
+// wrapText breaks text at spaces so no line is wider than width, splitting
+// words that are too long on their own. A width <= 0 only splits at '\n'.
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		if width <= 0 {
+			lines = append(lines, para)
+			continue
+		}
+		line, lineW := "", 0
+		for _, word := range strings.Fields(para) {
+			wordW := StringWidth(word)
+			if lineW > 0 && lineW+1+wordW <= width {
+				line += " " + word
+				lineW += 1 + wordW
+				continue
+			}
+			if lineW > 0 {
+				lines = append(lines, line)
+				line, lineW = "", 0
+			}
+			for wordW > width {
+				head, headW := "", 0
+				for len(word) > 0 {
+					cluster, cw, rest := nextGrapheme(word)
+					if headW+cw > width && headW > 0 {
+						break
+					}
+					head += cluster
+					headW += cw
+					word = rest
+				}
+				lines = append(lines, head)
+				wordW -= headW
+			}
+			line, lineW = word, wordW
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func isGraphemeExtend(r rune) bool {
+	return (r >= 0xfe00 && r <= 0xfe0f) || (r >= 0x1f3fb && r <= 0x1f3ff) ||
+		unicode.In(r, unicode.Mn, unicode.Me)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// nextGrapheme splits off the first user-perceived character of s: a base
+// rune plus any combining marks, variation selectors, skin-tone modifiers,
+// ZWJ-joined runes, or the second half of a regional-indicator flag.
+func nextGrapheme(s string) (cluster string, width int, rest string) {
+	r, i := utf8.DecodeRuneInString(s)
+	width = RuneWidth(r)
+	joined := false
+	pairable := isRegionalIndicator(r)
+	for i < len(s) {
+		next, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case joined:
+			joined = false
+		case next == 0x200d:
+			joined = true
+		case next == 0xfe0f:
+			width = 2
+		case isGraphemeExtend(next):
+		case pairable && isRegionalIndicator(next):
+			pairable = false
+			width = 2
+		default:
+			return s[:i], max(width, 1), s[i:]
+		}
+		i += n
+	}
+	return s, max(width, 1), ""
+}
+
+func SetLineDrawingMode(mode LineDrawingMode) {
+	term.lineMode = mode
+}
+
+func detectLineDrawing() LineDrawingMode {
+	locale := os.Getenv("LC_ALL")
+	if locale == "" {
+		locale = os.Getenv("LC_CTYPE")
+	}
+	if locale == "" {
+		locale = os.Getenv("LANG")
+	}
+	locale = strings.ToLower(locale)
+	if strings.Contains(locale, "utf-8") || strings.Contains(locale, "utf8") {
+		return LineDrawingUnicode
+	}
+	return LineDrawingASCII
+}
+
+func SetBoxChars(tl, tr, bl, br, h, v rune) {
+	term.boxChars = boxChars{tl, tr, bl, br, h, v}
+	term.boxCustom = true
+}
+
+func ResetBoxChars() {
+	term.boxCustom = false
+}
+
+func currentBoxChars() boxChars {
+	if term.boxCustom {
+		return term.boxChars
+	}
+	if term.lineMode == LineDrawingASCII {
+		return asciiBox
+	}
+	return unicodeBox
+}
+
+func Box(x, y, w, h int) {
+	drawBox(x, y, w, h, currentBoxChars())
+}
+
+// BoxTitled draws a box like Box with title set into its top border,
+// `┌─ Title ─┐`, left-aligned.
+func BoxTitled(x, y, w, h int, title string) {
+	BoxTitledAlign(x, y, w, h, title, AlignLeft)
+}
+
+// BoxTitledAlign is BoxTitled with the title placed by align. A title too
+// long for the border is cut short and ends in "…"; one that can't fit at
+// all is left out.
+func BoxTitledAlign(x, y, w, h int, title string, align Align) {
+	Box(x, y, w, h)
+	avail := w - 6
+	if title == "" || avail < 1 || h < 2 {
+		return
+	}
+	title, tw := ellipsize(title, avail)
+	start := x + 3
+	switch align {
+	case AlignCenter:
+		start += (avail - tw) / 2
+	case AlignRight:
+		start += avail - tw
+	}
+	SetCell(start-1, y, ' ', term.currentFg, term.currentBg)
+	SetCell(start+tw, y, ' ', term.currentFg, term.currentBg)
+	PushClip(start, y, tw, 1)
+	PrintAt(start, y, title)
+	PopClip()
+}
+
+// ellipsize cuts s to at most width columns, ending it in "…" if anything
+// was cut, and returns the result with its width.
+func ellipsize(s string, width int) (string, int) {
+	if w := StringWidth(s); w <= width {
+		return s, w
+	}
+	var b strings.Builder
+	w := 0
+	for rest := s; rest != ""; {
+		cluster, cw, next := nextGrapheme(rest)
+		if w+cw > width-1 {
+			break
+		}
+		b.WriteString(cluster)
+		w += cw
+		rest = next
+	}
+	b.WriteString("…")
+	return b.String(), w + 1
+}
+
+func DrawShadowBox(x, y, w, h int) {
+	if w < 2 || h < 2 {
+		return
+	}
+	bc := roundBox
+	if term.lineMode == LineDrawingASCII {
+		bc = asciiRound
+	}
+	drawBox(x, y, w, h, bc)
+	for i := 1; i <= h; i++ {
+		shadeCell(x+w, y+i)
+	}
+	for i := 1; i < w; i++ {
+		shadeCell(x+i, y+h)
+	}
+}
+
+func shadeCell(x, y int) {
+	x += term.offsetX
+	y += term.offsetY
+	if !inClip(x, y) {
+		return
+	}
+	cell := &term.buffer.Cells[y][x]
+	cell.Fg = darkenColor(cell.Fg)
+	cell.Bg = darkenColor(cell.Bg)
+	cell.Dirty = true
+	markRow(y)
+}
+
+func darkenColor(c int) int {
+	r, g, b := ColorToRGB(c)
+	return RGBToColor(r/2, g/2, b/2)
+}
+
+func BlendColor(a, b [3]int, t float64) [3]int {
+	t = min(max(t, 0), 1)
+	var out [3]int
+	for i := range out {
+		out[i] = int(float64(a[i]) + (float64(b[i])-float64(a[i]))*t + 0.5)
+	}
+	return out
+}
+
+// FadeRegion blends the background of each cell in the rectangle toward
+// the given color by t, from 0 (unchanged) to 1. A background that moves
+// becomes an RGBColor, exact on truecolor terminals; one that doesn't keeps
+// its palette index and the cell is left alone.
+func FadeRegion(x, y, w, h int, toward [3]int, t float64) {
+	if t <= 0 {
+		return
+	}
+	x += term.offsetX
+	y += term.offsetY
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			if !inClip(x+dx, y+dy) {
+				continue
+			}
+			cell := &term.buffer.Cells[y+dy][x+dx]
+			r, g, b := ColorToRGB(cell.Bg)
+			from := [3]int{r, g, b}
+			if c := BlendColor(from, toward, t); c != from {
+				cell.Bg = RGBColor(c[0], c[1], c[2])
+				cell.Dirty = true
+				markRow(y + dy)
+			}
+		}
+	}
+}
+
+// DrawImageBlocks scales img into the w x h cells at x, y using upper half
+// blocks: each cell's foreground is the top pixel and its background the
+// bottom one, giving two pixels per cell vertically. Colors are RGBColor
+// values, so they are exact on truecolor terminals.
+func DrawImageBlocks(x, y, w, h int, img image.Image) {
+	b := img.Bounds()
+	if w <= 0 || h <= 0 || b.Empty() {
+		return
+	}
+	for cy := 0; cy < h; cy++ {
+		for cx := 0; cx < w; cx++ {
+			top := averageColor(img, cx, 2*cy, w, 2*h)
+			bottom := averageColor(img, cx, 2*cy+1, w, 2*h)
+			SetCell(x+cx, y+cy, '▀', RGBColor(top[0], top[1], top[2]), RGBColor(bottom[0], bottom[1], bottom[2]))
+		}
+	}
+}
+
+// averageColor returns the mean 8-bit color of the part of img that lands in
+// pixel px, py of a w x h grid laid over it.
+func averageColor(img image.Image, px, py, w, h int) [3]int {
+	b := img.Bounds()
+	x0 := b.Min.X + px*b.Dx()/w
+	x1 := max(b.Min.X+(px+1)*b.Dx()/w, x0+1)
+	y0 := b.Min.Y + py*b.Dy()/h
+	y1 := max(b.Min.Y+(py+1)*b.Dy()/h, y0+1)
+	var sum [3]int
+	n := 0
+	for sy := y0; sy < y1 && sy < b.Max.Y; sy++ {
+		for sx := x0; sx < x1 && sx < b.Max.X; sx++ {
+			r, g, bl, _ := img.At(sx, sy).RGBA()
+			sum[0] += int(r >> 8)
+			sum[1] += int(g >> 8)
+			sum[2] += int(bl >> 8)
+			n++
+		}
+	}
+	if n == 0 {
+		return sum
+	}
+	return [3]int{sum[0] / n, sum[1] / n, sum[2] / n}
+}
+
+// Palette256RGB returns the RGB value of a 256-color index in xterm's
+// default palette: the 16 system colors, the 6x6x6 cube from 16 to 231 and
+// the gray ramp from 232 to 255. It's the table ColorToRGB reads from.
+func Palette256RGB(index int) (r, g, b int) {
+	return ColorToRGB(index)
+}
+
+func ColorToRGB(c int) (r, g, b int) {
+	if isRGBColor(c) {
+		return c >> 16 & 0xff, c >> 8 & 0xff, c & 0xff
+	}
+	c = clampColor(c)
+	switch {
+	case c < 16:
+		return ansiColors[c][0], ansiColors[c][1], ansiColors[c][2]
+	case c < 232:
+		c -= 16
+		return cubeLevels[c/36], cubeLevels[c/6%6], cubeLevels[c%6]
+	}
+	v := 8 + (c-232)*10
+	return v, v, v
+}
+
+func RGBToColor(r, g, b int) int {
+	nearest := func(v int) int {
+		best := 0
+		for i, level := range cubeLevels {
+			if abs(level-v) < abs(cubeLevels[best]-v) {
+				best = i
+			}
+		}
+		return best
+	}
+	ri, gi, bi := nearest(r), nearest(g), nearest(b)
+	cube := 16 + ri*36 + gi*6 + bi
+	cr, cg, cb := cubeLevels[ri], cubeLevels[gi], cubeLevels[bi]
+
+	gray := min(max((r+g+b)/3-8+5, 0)/10, 23)
+	gv := 8 + gray*10
+	if sqDist(r, g, b, gv, gv, gv) < sqDist(r, g, b, cr, cg, cb) {
+		return 232 + gray
+	}
+	return cube
+}
+
+func sqDist(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func drawBox(x, y, w, h int, bc boxChars) {
+	if w < 2 || h < 2 {
+		return
+	}
+
+	SetCell(x, y, bc.tl, term.currentFg, term.currentBg)
+	SetCell(x+w-1, y, bc.tr, term.currentFg, term.currentBg)
+	SetCell(x, y+h-1, bc.bl, term.currentFg, term.currentBg)
+	SetCell(x+w-1, y+h-1, bc.br, term.currentFg, term.currentBg)
+
+	for i := 1; i < w-1; i++ {
+		SetCell(x+i, y, bc.h, term.currentFg, term.currentBg)
+		SetCell(x+i, y+h-1, bc.h, term.currentFg, term.currentBg)
+	}
+
+	for i := 1; i < h-1; i++ {
+		SetCell(x, y+i, bc.v, term.currentFg, term.currentBg)
+		SetCell(x+w-1, y+i, bc.v, term.currentFg, term.currentBg)
+	}
+}
+
+func DrawButton(x, y, w int, label string, pressed bool) {
+	if w < 2 {
+		return
+	}
+	rev := term.currentRev
+	term.currentRev = rev != pressed
+	Fill(x, y, w, 1, ' ')
+	SetCell(x, y, '[', term.currentFg, term.currentBg)
+	SetCell(x+w-1, y, ']', term.currentFg, term.currentBg)
+	PushClip(x+1, y, w-2, 1)
+	PrintAt(x+1+max((w-2-StringWidth(label))/2, 0), y, label)
+	PopClip()
+	term.currentRev = rev
+}
+
+// Gauge is a bar or meter showing Value between Min and Max. The fill is
+// green, then yellow from the Warn fraction and red from Crit; zero
+// thresholds mean 0.7 and 0.9.
+type Gauge struct {
+	Min, Max, Value float64
+	Label           string
+	Vertical        bool
+	Warn, Crit      float64
+}
+
+func (g Gauge) Fraction() float64 {
+	if g.Max <= g.Min {
+		return 0
+	}
+	return min(max((g.Value-g.Min)/(g.Max-g.Min), 0), 1)
+}
+
+func (g Gauge) Color() int {
+	warn, crit := g.Warn, g.Crit
+	if warn == 0 {
+		warn = 0.7
+	}
+	if crit == 0 {
+		crit = 0.9
+	}
+	switch f := g.Fraction(); {
+	case f >= crit:
+		return 1
+	case f >= warn:
+		return 3
+	}
+	return 2
+}
+
+// Draw lays a horizontal gauge out as label, bar and percentage on one row,
+// or with the label and percentage above the bar when r is taller. A vertical
+// gauge has the label on top, the percentage at the bottom and a meter with
+// tick marks at every quarter in between, filling upward.
+func (g Gauge) Draw(r Rect) {
+	if r.W <= 0 || r.H <= 0 {
+		return
+	}
+	fg := term.currentFg
+	defer func() { term.currentFg = fg }()
+	PushClip(r.X, r.Y, r.W, r.H)
+	defer PopClip()
+
+	trackCh, fillCh := scrollbarRunes()
+	readout := fmt.Sprintf("%3.0f%%", g.Fraction()*100)
+	bar := func(x, y, n int) {
+		filled := int(g.Fraction()*float64(n) + 0.5)
+		for i := 0; i < n; i++ {
+			if i < filled {
+				SetCell(x+i, y, fillCh, g.Color(), term.currentBg)
+			} else {
+				SetCell(x+i, y, trackCh, 8, term.currentBg)
+			}
+		}
+	}
+
+	if !g.Vertical {
+		PrintAt(r.X, r.Y, g.Label)
+		PrintAt(r.X+r.W-len(readout), r.Y, readout)
+		if r.H == 1 {
+			x := r.X
+			if g.Label != "" {
+				x += StringWidth(g.Label) + 1
+			}
+			bar(x, r.Y, r.X+r.W-len(readout)-1-x)
+			return
+		}
+		for y := r.Y + 1; y < r.Y+r.H; y++ {
+			bar(r.X, y, r.W)
+		}
+		return
+	}
+
+	top, bottom := r.Y, r.Y+r.H-1
+	if g.Label != "" {
+		PrintAt(r.X, top, g.Label)
+		top++
+	}
+	PrintAt(r.X, bottom, readout)
+	n := bottom - top
+	if n <= 0 {
+		return
+	}
+	bc := currentBoxChars()
+	filled := int(g.Fraction()*float64(n) + 0.5)
+	for i := 0; i < n; i++ {
+		y := bottom - 1 - i
+		tick := bc.v
+		for q := 0; q <= 4; q++ {
+			if (q*(n-1)+2)/4 == i {
+				tick = bc.h
+			}
+		}
+		SetCell(r.X, y, tick, fg, term.currentBg)
+		ch, color := trackCh, 8
+		if i < filled {
+			ch, color = fillCh, g.Color()
+		}
+		for x := r.X + 1; x < r.X+r.W; x++ {
+			SetCell(x, y, ch, color, term.currentBg)
+		}
+	}
+}
+
+// HitTest reports whether evt is a mouse event inside the w x h rectangle
+// at x, y. Check evt.Clicks as well to react to double clicks.
+func HitTest(evt Event, x, y, w, h int) bool {
+	return evt.Type == EventMouse && evt.X >= x && evt.X < x+w && evt.Y >= y && evt.Y < y+h
+}
+
+// LocalMouse maps a mouse event into the space set up by PushOffset and
+// reports whether it lands inside the current clip.
+func LocalMouse(evt Event) (x, y int, inside bool) {
+	return evt.X - term.offsetX, evt.Y - term.offsetY, inClip(evt.X, evt.Y)
+}
+
+func SplitHorizontal(r Rect, ratio float64) (left, right Rect) {
+	return SplitLeft(r, int(float64(r.W)*ratio))
+}
+
+func SplitVertical(r Rect, ratio float64) (top, bottom Rect) {
+	return SplitTop(r, int(float64(r.H)*ratio))
+}
+
+func SplitLeft(r Rect, cols int) (left, right Rect) {
+	cols = min(max(cols, 0), r.W)
+	return Rect{r.X, r.Y, cols, r.H}, Rect{r.X + cols, r.Y, r.W - cols, r.H}
+}
+
+func SplitRight(r Rect, cols int) (left, right Rect) {
+	return SplitLeft(r, r.W-min(max(cols, 0), r.W))
+}
+
+func SplitTop(r Rect, rows int) (top, bottom Rect) {
+	rows = min(max(rows, 0), r.H)
+	return Rect{r.X, r.Y, r.W, rows}, Rect{r.X, r.Y + rows, r.W, r.H - rows}
+}
+
+func SplitBottom(r Rect, rows int) (top, bottom Rect) {
+	return SplitTop(r, r.H-min(max(rows, 0), r.H))
+}
+
+// scrollThumb returns the start and length of a scrollbar thumb on a track
+// of the given length.
+func scrollThumb(track, total, visible, offset int) (start, size int) {
+	if total <= visible || total <= 0 {
+		return 0, track
+	}
+	size = min(max(track*visible/total, 1), track)
+	offset = min(max(offset, 0), total-visible)
+	start = (track - size) * offset / (total - visible)
+	return start, size
+}
+
+func scrollbarRunes() (trackCh, thumbCh rune) {
+	if term.lineMode == LineDrawingASCII {
+		return '|', '#'
+	}
+	return '░', '█'
+}
+
+func DrawScrollbar(x, y, height, total, visible, offset int) {
+	if height <= 0 {
+		return
+	}
+	trackCh, thumbCh := scrollbarRunes()
+	start, size := scrollThumb(height, total, visible, offset)
+	for i := 0; i < height; i++ {
+		ch := trackCh
+		if i >= start && i < start+size {
+			ch = thumbCh
+		}
+		SetCell(x, y+i, ch, term.currentFg, term.currentBg)
+	}
+}
+
+func DrawHScrollbar(x, y, width, total, visible, offset int) {
+	if width <= 0 {
+		return
+	}
+	trackCh, thumbCh := scrollbarRunes()
+	if trackCh == '|' {
+		trackCh = '-'
+	}
+	start, size := scrollThumb(width, total, visible, offset)
+	for i := 0; i < width; i++ {
+		ch := trackCh
+		if i >= start && i < start+size {
+			ch = thumbCh
+		}
+		SetCell(x+i, y, ch, term.currentFg, term.currentBg)
+	}
+}
+
+var (
+	shadeRunes      = []rune(" ░▒▓█")
+	asciiShadeRunes = []rune(" .+#@")
+	sparkRunes      = []rune("▁▂▃▄▅▆▇█")
+	asciiSparkRunes = []rune("_.-=+*#@")
+)
+
+// level maps t in [0,1] onto one of n steps.
+func level(t float64, n int) int {
+	if math.IsNaN(t) {
+		return 0
+	}
+	return min(max(int(t*float64(n)), 0), n-1)
+}
+
+// ShadeCell draws a shade block for intensity in [0,1], from blank to full.
+func ShadeCell(x, y int, intensity float64) {
+	runes := shadeRunes
+	if term.lineMode == LineDrawingASCII {
+		runes = asciiShadeRunes
+	}
+	SetCell(x, y, runes[level(intensity, len(runes))], term.currentFg, term.currentBg)
 }
 
-func Flush() {
-	Present()
+// GrayColor returns the step of the 256-color grayscale ramp for intensity
+// in [0,1].
+func GrayColor(intensity float64) int {
+	return 232 + level(intensity, 24)
 }
 
-func Fill(x, y, w, h int, ch rune) {
-	for dy := 0; dy < h; dy++ {
-		for dx := 0; dx < w; dx++ {
-			SetCell(x+dx, y+dy, ch, term.currentFg, term.currentBg)
-		}
-	}
+var rampStops = [...][][3]int{
+	RampHeat:    {{0, 0, 255}, {0, 255, 0}, {255, 255, 0}, {255, 0, 0}},
+	RampViridis: {{68, 1, 84}, {59, 82, 139}, {33, 145, 140}, {94, 201, 98}, {253, 231, 37}},
+	RampGray:    {{0, 0, 0}, {255, 255, 255}},
+	RampJet:     {{0, 0, 143}, {0, 0, 255}, {0, 255, 255}, {255, 255, 0}, {255, 0, 0}, {128, 0, 0}},
 }
 
-func PrintAt(x, y int, text string) {
-	for i, ch := range text {
-		SetCell(x+i, y, ch, term.currentFg, term.currentBg)
+// RampRGB maps t in [0,1] onto ramp, blending linearly between its stops.
+func RampRGB(ramp Ramp, t float64) (r, g, b int) {
+	if ramp < 0 || int(ramp) >= len(rampStops) {
+		ramp = RampHeat
 	}
+	stops := rampStops[ramp]
+	if math.IsNaN(t) {
+		t = 0
+	}
+	pos := min(max(t, 0), 1) * float64(len(stops)-1)
+	i := min(int(pos), len(stops)-2)
+	f := pos - float64(i)
+	mix := func(a, b int) int {
+		return int(math.Round(float64(a) + f*float64(b-a)))
+	}
+	lo, hi := stops[i], stops[i+1]
+	return mix(lo[0], hi[0]), mix(lo[1], hi[1]), mix(lo[2], hi[2])
 }
 
-func Box(x, y, w, h int) {
-	if w < 2 || h < 2 {
-		return
-	}
+// RampColor is RampRGB rounded to the nearest 256-color palette entry.
+func RampColor(ramp Ramp, t float64) int {
+	return RGBToColor(RampRGB(ramp, t))
+}
 
-	SetCell(x, y, BoxTopLeft, term.currentFg, term.currentBg)
-	SetCell(x+w-1, y, BoxTopRight, term.currentFg, term.currentBg)
-	SetCell(x, y+h-1, BoxBottomLeft, term.currentFg, term.currentBg)
-	SetCell(x+w-1, y+h-1, BoxBottomRight, term.currentFg, term.currentBg)
+// HeatmapColor returns the palette color for t in [0,1] on RampHeat.
+func HeatmapColor(t float64) int {
+	return RampColor(RampHeat, t)
+}
 
-	for i := 1; i < w-1; i++ {
-		SetCell(x+i, y, BoxHorizontal, term.currentFg, term.currentBg)
-		SetCell(x+i, y+h-1, BoxHorizontal, term.currentFg, term.currentBg)
+// DrawSparkline plots values left to right from x, one cell each, scaled
+// between their minimum and maximum.
+func DrawSparkline(x, y int, values []float64) {
+	runes := sparkRunes
+	if term.lineMode == LineDrawingASCII {
+		runes = asciiSparkRunes
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	for i, v := range values {
+		t := 0.0
+		if hi > lo {
+			t = (v - lo) / (hi - lo)
+		}
+		SetCell(x+i, y, runes[level(t, len(runes))], term.currentFg, term.currentBg)
 	}
+}
 
-	for i := 1; i < h-1; i++ {
-		SetCell(x, y+i, BoxVertical, term.currentFg, term.currentBg)
-		SetCell(x+w-1, y+i, BoxVertical, term.currentFg, term.currentBg)
+func SetBgRegion(x, y, w, h, bg int) {
+	x += term.offsetX
+	y += term.offsetY
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			if !inClip(x+dx, y+dy) {
+				continue
+			}
+			cell := &term.buffer.Cells[y+dy][x+dx]
+			if cell.Bg != bg {
+				cell.Bg = bg
+				cell.Dirty = true
+				markRow(y + dy)
+			}
+		}
 	}
 }
 
@@ -973,7 +4921,7 @@ func ClearLineToEOL(y int) {
 func ClearRegion(x, y, w, h int) {
 	for dy := 0; dy < h; dy++ {
 		for dx := 0; dx < w; dx++ {
-			SetCell(x+dx, y+dy, ' ', 7, 0)
+			SetCell(x+dx, y+dy, defaultCell.Ch, defaultCell.Fg, defaultCell.Bg)
 		}
 	}
 }
@@ -990,9 +4938,9 @@ func SetCursorVisible(visible bool) {
 	if visible != term.cursorVisible {
 		term.cursorVisible = visible
 		if visible {
-			writeString(ShowCursor)
+			writeOutput(ShowCursor)
 		} else {
-			writeString(HideCursor)
+			writeOutput(HideCursor)
 		}
 	}
 }
@@ -1006,117 +4954,301 @@ func Bell() {
 }
 
 func Suspend() {
-	if !term.initialized {
+	jobMu.Lock()
+	if !term.initialized || term.suspended {
+		jobMu.Unlock()
 		return
 	}
+	term.suspended = true
+	term.resumeAlt = term.altScreen
+	term.altScreen = false
 
 	disableRawMode()
 	term.isRaw = false
 
 	writeString(ClearScreen)
 	writeString(ShowCursor)
+	if term.cursorStyled {
+		writeString(DefaultCursor)
+	}
+	if term.scrollRegion {
+		writeString(ResetScrollMargins)
+	}
 	writeString(NormalScreen)
+	jobMu.Unlock()
 
 	syscall.Kill(syscall.Getpid(), syscall.SIGTSTP)
 }
 
 func Resume() {
-	if !term.initialized {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	// SIGCONT and an explicit call can both land after one suspend; the
+	// window also covers a stop/continue that didn't go through Suspend.
+	if !term.initialized || (!term.suspended && time.Since(term.lastResume) < 100*time.Millisecond) {
 		return
 	}
+	// A stop that skipped Suspend may have been from the alternate screen
+	// or not; going back to it is the safer guess.
+	alt := term.resumeAlt || !term.suspended
+	term.suspended = false
+	term.lastResume = time.Now()
 
+	clearNonblock(inFd)
 	enableRawMode()
 	term.isRaw = true
 
-	writeString(AlternateScreen)
+	if alt {
+		writeString(AlternateScreen)
+	}
+	term.altScreen = alt
 	if !term.cursorVisible {
 		writeString(HideCursor)
 	}
+	if term.cursorStyled {
+		SetCursorStyle(term.cursorStyle)
+	}
+	if term.scrollRegion {
+		writeString(fmt.Sprintf(SetScrollMargins, term.scrollTop+1, term.scrollBottom+1))
+	}
 	writeString(ClearScreen)
+	Invalidate()
+}
+
+// AltScreenActive reports whether output is going to the alternate screen.
+func AltScreenActive() bool {
+	return term.altScreen
+}
+
+// LeaveAltScreen switches drawing to the normal screen, for inline tools.
+// Close then blanks the rows Present drew on there and puts the cursor
+// back where it was before Init.
+//
+// This is cleanup, not a snapshot. What those rows held before can't be
+// read back from the terminal, so it is lost rather than restored. Rows are
+// tracked by screen position: if the screen scrolls while drawing (output
+// past the bottom row, a resize that reflows), Close blanks the rows now at
+// those positions, not the ones drawn on. Only Present is tracked, not
+// WriteAt or WriteEscape. The cursor goes back only if the terminal
+// answered the position query made here; otherwise it stays where the last
+// frame left it.
+func LeaveAltScreen() {
+	if !term.initialized || !term.altScreen {
+		return
+	}
+	writeString(ResetColor)
+	writeString(ShowCursor)
+	writeString(NormalScreen)
+	term.altScreen = false
+	// The normal screen gets a visible cursor; the app's choice for the
+	// alternate screen is kept for EnterAltScreen.
+	term.altCursorVisible = term.cursorVisible
+	term.cursorVisible = true
+	if !term.startKnown {
+		// Leaving the alternate screen restores the cursor saved on entry.
+		row, col, err := queryCursorReport(QueryCursorPos, 200*time.Millisecond)
+		term.startRow, term.startCol, term.startKnown = row, col, err == nil
+	}
+	Invalidate()
+}
 
+// trackNormalRows widens the band of normal-screen rows Present is about
+// to draw on, for restoreNormalScreen.
+func trackNormalRows() {
 	for y := 0; y < term.height; y++ {
-		for x := 0; x < term.width; x++ {
-			term.buffer.Cells[y][x].Dirty = true
+		if !term.buffer.dirtyRows[y] && term.renderMode != RenderFull {
+			continue
+		}
+		if !term.normalUsed {
+			term.normalUsed, term.normalTop, term.normalBottom = true, y, y
 		}
+		term.normalTop, term.normalBottom = min(term.normalTop, y), max(term.normalBottom, y)
 	}
 }
 
-func GetCursorPos() (x, y int) {
-	if !term.initialized {
-		return 0, 0
+// restoreNormalScreen blanks the normal-screen rows that were drawn on and
+// returns the cursor to where it was before Init. It can only erase: the
+// rows' earlier contents are gone, and the band is in screen coordinates,
+// so it is off by however far the screen scrolled since (see
+// LeaveAltScreen).
+func restoreNormalScreen() {
+	var out []byte
+	out = append(out, ResetColor...)
+	for y := term.normalTop; term.normalUsed && y <= term.normalBottom; y++ {
+		out = appendCursorMove(out, y+1, 1)
+		out = append(out, ESC+"[2K"...)
+	}
+	if term.startKnown {
+		out = appendCursorMove(out, term.startRow, term.startCol)
+	}
+	syscall.Write(outFd, out)
+}
+
+func EnterAltScreen() {
+	if !term.initialized || term.altScreen {
+		return
 	}
+	writeString(AlternateScreen)
+	term.cursorVisible = term.altCursorVisible
+	if !term.cursorVisible {
+		writeString(HideCursor)
+	}
+	if term.cursorStyled {
+		SetCursorStyle(term.cursorStyle)
+	}
+	writeString(ClearScreen)
+	term.altScreen = true
+	Invalidate()
+}
 
-	writeString(QueryCursorPos)
+// Shell runs cmd with the terminal handed over to it: cooked mode, the
+// normal screen, a visible default cursor and no mouse, paste or focus
+// reporting. Afterwards every mode the app had on is switched back on and
+// the screen is repainted on the next Present. Unset standard streams are
+// connected to the terminal.
+func Shell(cmd *exec.Cmd) error {
+	if !term.initialized {
+		return cmd.Run()
+	}
+	in, out := os.Stdin, os.Stdout
+	if ttyFile != nil {
+		in, out = ttyFile, ttyFile
+	}
+	if cmd.Stdin == nil {
+		cmd.Stdin = in
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = out
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = cmd.Stdout
+	}
 
-	var buf [32]byte
-	fd := int(syscall.Stdin)
+	mouse, paste, focus := term.mouseEnabled, term.pasteEnabled, term.focusEnabled
+	alt := term.altScreen
+	DisableMouse()
+	DisableBracketedPaste()
+	DisableFocusReporting()
+	writeString(ResetColor)
+	writeString(ShowCursor)
+	if term.cursorStyled {
+		writeString(DefaultCursor)
+	}
+	if alt {
+		writeString(NormalScreen)
+		term.altScreen = false
+	}
+	disableRawMode()
+	term.isRaw = false
 
-	fdSet := &syscall.FdSet{}
-	setFd(fdSet, fd)
-	tv := syscall.Timeval{Sec: 1, Usec: 0} // 1 second timeout
+	err := cmd.Run()
 
-	n, err := selectRead(fd, fdSet, &tv)
-	if err != nil {
-		return 0, 0
+	clearNonblock(inFd)
+	enableRawMode()
+	term.isRaw = true
+	if alt {
+		writeString(AlternateScreen)
+		term.altScreen = true
 	}
-	if n <= 0 {
-		return 0, 0
+	if !term.cursorVisible {
+		writeString(HideCursor)
+	}
+	if term.cursorStyled {
+		SetCursorStyle(term.cursorStyle)
+	}
+	if mouse {
+		EnableMouse()
+	}
+	if paste {
+		EnableBracketedPaste()
+	}
+	if focus {
+		EnableFocusReporting()
 	}
+	if width, height, err := getTermSize(); err == nil {
+		resize(width, height)
+	}
+	writeString(ClearScreen)
+	Invalidate()
+	return err
+}
 
-	n, err = syscall.Read(syscall.Stdin, buf[:])
-	if err != nil || n < 6 {
-		return 0, 0
+func clearNonblock(fd int) {
+	flags, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), F_GETFL, 0)
+	if e == 0 && flags&O_NONBLOCK != 0 {
+		syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), F_SETFL, flags&^O_NONBLOCK)
 	}
+}
 
-	// Parse response: \x1b[row;colR
-	response := string(buf[:n])
-	if len(response) >= 6 && response[0] == '\x1b' && response[1] == '[' {
-		var row, col int
-		if _, err := fmt.Sscanf(response[2:], "%d;%dR", &row, &col); err == nil {
-			return col - 1, row - 1 // Convert to 0-based
-		}
+func GetCursorPos() (x, y int) {
+	if !term.initialized {
+		return 0, 0
+	}
+	row, col, err := queryCursorReport(QueryCursorPos, time.Second)
+	if err != nil {
+		return 0, 0
 	}
+	return col - 1, row - 1 // Convert to 0-based
+}
 
-	return 0, 0
+// FillRun fills count cells of row y from x with ch in the current colors.
+// With SetRepeatOutput on, Present sends such a run as one character and a
+// REP.
+func FillRun(x, y, count int, ch rune) {
+	HLine(x, y, count, ch)
 }
 
 func HLine(x, y, length int, ch rune) {
 	for i := 0; i < length; i++ {
-		if x+i < term.width {
-			SetCell(x+i, y, ch, term.currentFg, term.currentBg)
-		}
+		SetCell(x+i, y, ch, term.currentFg, term.currentBg)
 	}
 }
 
 func VLine(x, y, length int, ch rune) {
 	for i := 0; i < length; i++ {
-		if y+i < term.height {
-			SetCell(x, y+i, ch, term.currentFg, term.currentBg)
-		}
+		SetCell(x, y+i, ch, term.currentFg, term.currentBg)
 	}
 }
 
 func DrawBytes(x, y int, data []byte) {
 	for i, b := range data {
-		if x+i < term.width && x+i >= 0 {
-			SetCell(x+i, y, rune(b), term.currentFg, term.currentBg)
-		}
+		SetCell(x+i, y, rune(b), term.currentFg, term.currentBg)
 	}
 }
 
 func ClearRect(x, y, w, h int) {
 	for dy := 0; dy < h; dy++ {
 		for dx := 0; dx < w; dx++ {
-			if x+dx >= 0 && x+dx < term.width && y+dy >= 0 && y+dy < term.height {
-				SetCell(x+dx, y+dy, ' ', 7, term.currentBg)
-			}
+			SetCell(x+dx, y+dy, defaultCell.Ch, defaultCell.Fg, term.currentBg)
 		}
 	}
 }
 
+func FillRect(r Rect, ch rune) {
+	Fill(r.X, r.Y, r.W, r.H, ch)
+}
+
+func BoxRect(r Rect) {
+	Box(r.X, r.Y, r.W, r.H)
+}
+
+func ClearRectR(r Rect) {
+	ClearRect(r.X, r.Y, r.W, r.H)
+}
+
 func SetCursor(x, y int) {
-	term.cursorX = x
-	term.cursorY = y
+	term.cursorX = x + term.offsetX
+	term.cursorY = y + term.offsetY
+}
+
+// MoveCursorRel moves the cursor by dx, dy, keeping it on screen.
+func MoveCursorRel(dx, dy int) {
+	term.cursorX = min(max(term.cursorX+dx, 0), max(term.width-1, 0))
+	term.cursorY = min(max(term.cursorY+dy, 0), max(term.height-1, 0))
+}
+
+func CursorPos() (x, y int) {
+	return term.cursorX - term.offsetX, term.cursorY - term.offsetY
 }
 
 func HideCursorFunc() {
@@ -1129,7 +5261,18 @@ func ShowCursorFunc() {
 
 func SetCursorStyle(style int) {
 	term.cursorStyle = style
-	writeString(fmt.Sprintf(ESC+"[%d q", style))
+	term.cursorStyled = true
+	var buf [16]byte
+	out := append(buf[:0], '', '[')
+	out = appendInt(out, style)
+	writeOutputBytes(append(out, ' ', 'q'))
+}
+
+// SetCursorColor sets the hardware cursor color; Close puts the terminal's
+// default back. Terminals without OSC 12 ignore it.
+func SetCursorColor(r, g, b int) {
+	writeString(wrapOSC(fmt.Sprintf(SetCursorColorRGB, r&0xff, g&0xff, b&0xff)))
+	term.cursorColored = true
 }
 
 func EnableMouseFunc() {
@@ -1145,12 +5288,12 @@ func SetInputMode(escDelay int) {
 }
 
 func FlushInput() {
-	fd := int(syscall.Stdin)
+	fd := inFd
 	flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), F_GETFL, 0)
 	syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), F_SETFL, flags|O_NONBLOCK)
 	var buf [1024]byte
 	for {
-		_, err := syscall.Read(syscall.Stdin, buf[:])
+		_, err := syscall.Read(inFd, buf[:])
 		if err != nil {
 			break
 		}
@@ -1192,11 +5335,12 @@ func RestoreBuffer() {
 			}
 		}
 	}
+	markAllRows()
 }
 
 func GetCell(x, y int) (ch rune, fg, bg int) {
 	if x < 0 || x >= term.width || y < 0 || y >= term.height {
-		return ' ', 7, 0
+		return defaultCell.Ch, defaultCell.Fg, defaultCell.Bg
 	}
 
 	cell := term.buffer.Cells[y][x]
@@ -1204,36 +5348,516 @@ func GetCell(x, y int) (ch rune, fg, bg int) {
 }
 
 func Scroll(lines int) {
+	ScrollFill(lines, term.currentFg, term.currentBg)
+}
+
+func ScrollFill(lines int, fg, bg int) {
+	scrollRect(Rect{0, 0, term.width, term.height}, lines, fg, bg)
+}
+
+func ScrollRegion(r Rect, lines int) {
+	r.X += term.offsetX
+	r.Y += term.offsetY
+	x0, y0 := max(r.X, 0), max(r.Y, 0)
+	x1, y1 := min(r.X+r.W, term.width), min(r.Y+r.H, term.height)
+	if x1 <= x0 || y1 <= y0 {
+		return
+	}
+	scrollRect(Rect{x0, y0, x1 - x0, y1 - y0}, lines, term.currentFg, term.currentBg)
+}
+
+// scrollRect moves the rows of r (screen coordinates, already on screen)
+// down by lines, or up when lines is negative, filling the gap with blanks.
+func scrollRect(r Rect, lines int, fg, bg int) {
 	if lines == 0 {
 		return
 	}
+	blank := blankCell()
+	blank.Fg, blank.Bg = fg, bg
+	top, bottom := r.Y, r.Y+r.H
 
 	if lines > 0 {
-		for y := term.height - 1; y >= lines; y-- {
-			for x := 0; x < term.width; x++ {
+		for y := bottom - 1; y >= top+lines; y-- {
+			for x := r.X; x < r.X+r.W; x++ {
 				term.buffer.Cells[y][x] = term.buffer.Cells[y-lines][x]
 				term.buffer.Cells[y][x].Dirty = true
 			}
 		}
 
-		for y := 0; y < lines && y < term.height; y++ {
-			for x := 0; x < term.width; x++ {
-				term.buffer.Cells[y][x] = Cell{Ch: ' ', Fg: 7, Bg: 0, Dirty: true}
+		for y := top; y < top+lines && y < bottom; y++ {
+			for x := r.X; x < r.X+r.W; x++ {
+				term.buffer.Cells[y][x] = blank
 			}
 		}
 	} else {
 		lines = -lines
-		for y := 0; y < term.height-lines; y++ {
-			for x := 0; x < term.width; x++ {
+		for y := top; y < bottom-lines; y++ {
+			for x := r.X; x < r.X+r.W; x++ {
 				term.buffer.Cells[y][x] = term.buffer.Cells[y+lines][x]
 				term.buffer.Cells[y][x].Dirty = true
 			}
 		}
 
-		for y := term.height - lines; y < term.height; y++ {
-			for x := 0; x < term.width; x++ {
-				term.buffer.Cells[y][x] = Cell{Ch: ' ', Fg: 7, Bg: 0, Dirty: true}
+		for y := max(bottom-lines, top); y < bottom; y++ {
+			for x := r.X; x < r.X+r.W; x++ {
+				term.buffer.Cells[y][x] = blank
+			}
+		}
+	}
+	for y := top; y < bottom; y++ {
+		markRow(y)
+	}
+}
+
+// CellWriter is an io.Writer that prints into Rect like a small terminal:
+// text wraps at the right edge, '\n' moves to the next line, '\r' returns to
+// the left edge and the region scrolls up once the bottom line is full.
+// It draws with the style current at its first Write; SGR sequences in the
+// stream change that style and other escape sequences are dropped.
+type CellWriter struct {
+	Rect    Rect
+	x, y    int
+	style   Style
+	base    Style
+	started bool
+	partial []byte
+
+	cluster            string
+	clusterX, clusterY int
+	clusterW           int
+	joining            bool
+}
+
+func (w *CellWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.style = CurrentStyle()
+		w.base = w.style
+		w.started = true
+	}
+	prev := CurrentStyle()
+	SetStyle(w.style)
+	defer SetStyle(prev)
+
+	data := p
+	if len(w.partial) > 0 {
+		data = append(w.partial, p...)
+		w.partial = nil
+	}
+	for len(data) > 0 {
+		b := data[0]
+		if b < 0x20 && b != 0x1b {
+			w.cluster = ""
+		}
+		switch {
+		case b == '\n':
+			w.newline()
+		case b == '\r':
+			w.x = 0
+		case b == '\t':
+			w.x = min((w.x/8+1)*8, max(w.Rect.W-1, 0))
+		case b == '\b':
+			w.x = max(w.x-1, 0)
+		case b == 0x1b:
+			n := w.escape(data)
+			if n == 0 {
+				w.partial = append([]byte(nil), data...)
+				return len(p), nil
+			}
+			data = data[n:]
+			continue
+		case b < 0x20 || b == 0x7f:
+		default:
+			if !utf8.FullRune(data) {
+				w.partial = append([]byte(nil), data...)
+				return len(p), nil
+			}
+			r, size := utf8.DecodeRune(data)
+			w.put(r)
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+	return len(p), nil
+}
+
+// escape consumes the escape sequence at the start of data and returns its
+// length, or 0 if the sequence is not complete yet.
+func (w *CellWriter) escape(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	switch data[1] {
+	case '[':
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				if data[i] == 'm' {
+					w.sgr(string(data[2:i]))
+				}
+				return i + 1
+			}
+		}
+		return 0
+	case ']':
+		for i := 2; i < len(data); i++ {
+			if data[i] == 0x07 {
+				return i + 1
+			}
+			if data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return 0
+	}
+	return 2
+}
+
+func (w *CellWriter) sgr(params string) {
+	// Each parameter may carry colon subparameters (4:3, 38:2::r:g:b); an
+	// empty or unparsable subparameter is -1.
+	var codes [][]int
+	for _, f := range strings.Split(params, ";") {
+		var p []int
+		for j, part := range strings.Split(f, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				n = -1
+				if j == 0 {
+					n = 0
+				}
+			}
+			p = append(p, n)
+		}
+		codes = append(codes, p)
+	}
+	s := &w.style
+	for i := 0; i < len(codes); i++ {
+		sub := codes[i][1:]
+		switch c := codes[i][0]; {
+		case c == 0:
+			*s = w.base
+		case c == 1:
+			s.Bold = true
+		case c == 3:
+			s.Italic = true
+		case c == 4:
+			s.Under = len(sub) == 0 || sub[0] != 0
+		case c == 7:
+			s.Rev = true
+		case c == 9:
+			s.Strike = true
+		case c == 22:
+			s.Bold = false
+		case c == 23:
+			s.Italic = false
+		case c == 24:
+			s.Under = false
+		case c == 27:
+			s.Rev = false
+		case c == 29:
+			s.Strike = false
+		case c >= 30 && c <= 37:
+			s.Fg = c - 30
+		case c == 39:
+			s.Fg = w.base.Fg
+		case c >= 40 && c <= 47:
+			s.Bg = c - 40
+		case c == 49:
+			s.Bg = w.base.Bg
+		case c >= 90 && c <= 97:
+			s.Fg = c - 90 + 8
+		case c >= 100 && c <= 107:
+			s.Bg = c - 100 + 8
+		case c == 38 || c == 48:
+			color := -1
+			switch {
+			case len(sub) >= 2 && sub[0] == 5:
+				color = clampColor(sub[1])
+			case len(sub) >= 4 && sub[0] == 2:
+				rgb := sub[len(sub)-3:]
+				color = RGBColor(rgb[0], rgb[1], rgb[2])
+			case len(sub) > 0:
+				continue
+			case i+2 < len(codes) && codes[i+1][0] == 5:
+				color = clampColor(codes[i+2][0])
+				i += 2
+			case i+4 < len(codes) && codes[i+1][0] == 2:
+				color = RGBColor(codes[i+2][0], codes[i+3][0], codes[i+4][0])
+				i += 4
 			}
+			if color < 0 {
+				// A bare or truncated 38/48 is skipped; the rest still apply.
+				continue
+			}
+			if c == 38 {
+				s.Fg = color
+			} else {
+				s.Bg = color
+			}
+		}
+	}
+	SetStyle(*s)
+}
+
+func (w *CellWriter) put(r rune) {
+	rw := RuneWidth(r)
+	if w.Rect.W <= 0 {
+		return
+	}
+	// Combining marks and anything after a ZWJ join the previous cell's
+	// cluster, which can arrive in a later Write than its base.
+	if w.cluster != "" && (isGraphemeExtend(r) || r == 0x200d || w.joining) {
+		w.cluster += string(r)
+		w.joining = r == 0x200d
+		setCluster(w.clusterX, w.clusterY, w.cluster, w.clusterW, w.style.Fg, w.style.Bg)
+		return
+	}
+	if rw == 0 {
+		return
+	}
+	if w.x+rw > w.Rect.W {
+		w.newline()
+	}
+	w.cluster, w.clusterW = string(r), rw
+	w.clusterX, w.clusterY = w.Rect.X+w.x, w.Rect.Y+w.y
+	setCluster(w.clusterX, w.clusterY, w.cluster, rw, w.style.Fg, w.style.Bg)
+	w.x += rw
+}
+
+func (w *CellWriter) newline() {
+	w.x = 0
+	w.y++
+	if w.y >= w.Rect.H {
+		ScrollRegion(w.Rect, -1)
+		w.y = max(w.Rect.H-1, 0)
+	}
+}
+
+type Viewport struct {
+	Rect Rect
+}
+
+func (v *Viewport) enter() {
+	PushOffset(v.Rect.X, v.Rect.Y)
+	PushClip(0, 0, v.Rect.W, v.Rect.H)
+}
+
+func (v *Viewport) leave() {
+	PopClip()
+	PopOffset()
+}
+
+func (v *Viewport) Size() (width, height int) {
+	return v.Rect.W, v.Rect.H
+}
+
+func (v *Viewport) SetCell(x, y int, ch rune, fg, bg int) {
+	v.enter()
+	SetCell(x, y, ch, fg, bg)
+	v.leave()
+}
+
+func (v *Viewport) PrintAt(x, y int, text string) {
+	v.enter()
+	PrintAt(x, y, text)
+	v.leave()
+}
+
+func (v *Viewport) Fill(x, y, w, h int, ch rune) {
+	v.enter()
+	Fill(x, y, w, h, ch)
+	v.leave()
+}
+
+func (v *Viewport) Box(x, y, w, h int) {
+	v.enter()
+	Box(x, y, w, h)
+	v.leave()
+}
+
+func (v *Viewport) Clear() {
+	v.Fill(0, 0, v.Rect.W, v.Rect.H, ' ')
+}
+
+func (v *Viewport) Scroll(lines int) {
+	ScrollRegion(v.Rect, lines)
+}
+
+// Node is an element of a retained UI tree: it reports how tall it wants to
+// be at a given width and draws itself into a rect.
+type Node interface {
+	Height(width int) int
+	Draw(r Rect)
+}
+
+// Component produces the tree a Reconciler keeps on screen.
+type Component interface {
+	Render() Node
+}
+
+type Text struct {
+	Content string
+	Style   Style
+	Align   Align
+}
+
+func (t Text) Height(width int) int {
+	_, h := MeasureText(t.Content, width)
+	return h
+}
+
+func (t Text) Draw(r Rect) {
+	DrawText(r, t.Content, t.Style, t.Align)
+}
+
+// BoxNode frames Child with a border and an optional title.
+type BoxNode struct {
+	Title string
+	Style Style
+	Child Node
+}
+
+func (b BoxNode) Height(width int) int {
+	if b.Child == nil {
+		return 2
+	}
+	return b.Child.Height(width-2) + 2
+}
+
+func (b BoxNode) Draw(r Rect) {
+	prev := CurrentStyle()
+	SetStyle(b.Style)
+	BoxTitled(r.X, r.Y, r.W, r.H, b.Title)
+	SetStyle(prev)
+	if b.Child != nil {
+		b.Child.Draw(Rect{r.X + 1, r.Y + 1, r.W - 2, r.H - 2})
+	}
+}
+
+// VStack puts its children under each other, each at its own height.
+type VStack []Node
+
+func (s VStack) Height(width int) int {
+	h := 0
+	for _, n := range s {
+		h += n.Height(width)
+	}
+	return h
+}
+
+func (s VStack) Draw(r Rect) {
+	rest := r
+	for _, n := range s {
+		var top Rect
+		top, rest = SplitTop(rest, n.Height(r.W))
+		n.Draw(top)
+	}
+}
+
+// HStack puts its children side by side in equal shares of the width.
+type HStack []Node
+
+func (s HStack) Height(width int) int {
+	h := 0
+	for i, n := range s {
+		h = max(h, n.Height(s.share(width, i)))
+	}
+	return h
+}
+
+func (s HStack) share(width, i int) int {
+	w := width / len(s)
+	if i == len(s)-1 {
+		w = width - w*(len(s)-1)
+	}
+	return w
+}
+
+func (s HStack) Draw(r Rect) {
+	rest := r
+	for i, n := range s {
+		var left Rect
+		left, rest = SplitLeft(rest, s.share(r.W, i))
+		n.Draw(left)
+	}
+}
+
+// Reconciler keeps a Component's tree drawn in a rect. Update renders the
+// component and, if the tree changed, draws it off screen and copies over
+// only the cells that differ from the last frame.
+type Reconciler struct {
+	Root  Component
+	tree  Node
+	frame Buffer
+	rect  Rect
+}
+
+// Update reports whether anything was redrawn.
+func (rc *Reconciler) Update(r Rect) bool {
+	tree := rc.Root.Render()
+	// Diff works in screen coordinates.
+	sr := Rect{r.X + term.offsetX, r.Y + term.offsetY, r.W, r.H}
+	fresh := rc.frame.Width != term.width || rc.frame.Height != term.height || rc.rect != sr
+	if !fresh && nodeEqual(tree, rc.tree) {
+		return false
+	}
+
+	screen := term.buffer
+	term.buffer = initBuffer(term.width, term.height)
+	PushClip(r.X, r.Y, r.W, r.H)
+	tree.Draw(r)
+	PopClip()
+	next := term.buffer
+	term.buffer = screen
+
+	prev := rc.frame
+	if fresh {
+		prev = Buffer{}
+	}
+	var changes []CellChange
+	for _, ch := range Diff(prev, next) {
+		if ch.X >= sr.X && ch.X < sr.X+sr.W && ch.Y >= sr.Y && ch.Y < sr.Y+sr.H {
+			changes = append(changes, ch)
+		}
+	}
+	ApplyChanges(changes)
+
+	rc.tree, rc.frame, rc.rect = tree, next, sr
+	return len(changes) > 0
+}
+
+// nodeEqual compares the built-in nodes field by field. Other node types
+// are equal only if they say so through an Equal(Node) bool method.
+func nodeEqual(a, b Node) bool {
+	switch a := a.(type) {
+	case Text:
+		b, ok := b.(Text)
+		return ok && a == b
+	case BoxNode:
+		bb, ok := b.(BoxNode)
+		return ok && a.Title == bb.Title && a.Style == bb.Style && nodeEqual(a.Child, bb.Child)
+	case VStack:
+		b, ok := b.(VStack)
+		return ok && nodesEqual(a, b)
+	case HStack:
+		b, ok := b.(HStack)
+		return ok && nodesEqual(a, b)
+	case nil:
+		return b == nil
+	case interface{ Equal(Node) bool }:
+		return a.Equal(b)
+	}
+	return false
+}
+
+func nodesEqual(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !nodeEqual(a[i], b[i]) {
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,1988 @@
+package tb
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetTerm puts the global terminal into a known state with blank
+// width x height buffers, as if Init had just run, without touching a tty.
+func resetTerm(t *testing.T, width, height int) {
+	t.Helper()
+	term = Terminal{}
+	term.width, term.height = width, height
+	term.buffer = initBuffer(width, height)
+	term.backBuffer = initBuffer(width, height)
+	t.Cleanup(func() { term = Terminal{} })
+}
+
+// capturePresent runs Present with outFd pointed at a pipe and returns the
+// bytes it wrote.
+func capturePresent(t *testing.T) []byte {
+	t.Helper()
+	return captureOutput(t, Present)
+}
+
+// captureOutput runs fn with outFd pointed at a pipe and returns the bytes
+// it wrote.
+func captureOutput(tb testing.TB, fn func()) []byte {
+	tb.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	saved := outFd
+	outFd = int(w.Fd())
+	fn()
+	outFd = saved
+	w.Close()
+	var out bytes.Buffer
+	out.ReadFrom(r)
+	return out.Bytes()
+}
+
+func TestPresentStrike(t *testing.T) {
+	resetTerm(t, 3, 1)
+	for x := 0; x < 3; x++ {
+		term.backBuffer.Cells[0][x] = term.buffer.Cells[0][x]
+	}
+	Strike(true)
+	SetCell(0, 0, 'a', 7, 0)
+	Strike(false)
+	SetCell(1, 0, 'b', 7, 0)
+
+	got := string(capturePresent(t))
+	want := "\x1b[1;1H" + SetStrike + "\x1b[38;5;7m\x1b[48;5;0ma" + UnsetStrike + "b" + ResetColor
+	if got != want {
+		t.Errorf("Present wrote %q, want %q", got, want)
+	}
+	if got := string(capturePresent(t)); got != "" {
+		t.Errorf("second Present wrote %q, want nothing", got)
+	}
+}
+
+// discardOutput points outFd at /dev/null for the rest of the test.
+func discardOutput(tb testing.TB) {
+	tb.Helper()
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	saved := outFd
+	outFd = int(f.Fd())
+	tb.Cleanup(func() {
+		outFd = saved
+		f.Close()
+	})
+}
+
+// drawFrame changes every cell so Present has a full screen to send.
+func drawFrame(n int) {
+	for y := 0; y < term.height; y++ {
+		for x := 0; x < term.width; x++ {
+			SetCell(x, y, rune('a'+(x+y+n)%26), (x+n)%16, y%16)
+		}
+	}
+}
+
+func TestPresentAllocs(t *testing.T) {
+	resetTerm(t, 80, 24)
+	discardOutput(t)
+	drawFrame(0)
+	Present()
+
+	n := 1
+	allocs := testing.AllocsPerRun(20, func() {
+		drawFrame(n)
+		Present()
+		n++
+	})
+	if allocs != 0 {
+		t.Errorf("Present allocated %v times per frame, want 0", allocs)
+	}
+
+	if allocs := testing.AllocsPerRun(20, func() { SetCursorStyle(CursorLine) }); allocs != 0 {
+		t.Errorf("SetCursorStyle allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkPresent(b *testing.B) {
+	term = Terminal{width: 120, height: 40}
+	term.buffer = initBuffer(term.width, term.height)
+	term.backBuffer = initBuffer(term.width, term.height)
+	b.Cleanup(func() { term = Terminal{} })
+	discardOutput(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		drawFrame(i)
+		Present()
+	}
+}
+
+// contains reports whether s holds every one of subs.
+func contains(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// rowText returns the characters on row y of the buffer being drawn to.
+func rowText(y int) string {
+	var s []rune
+	for _, c := range term.buffer.Cells[y] {
+		s = append(s, c.Ch)
+	}
+	return string(s)
+}
+
+func TestPrintAtClip(t *testing.T) {
+	resetTerm(t, 10, 2)
+	PushClip(2, 0, 4, 1)
+	PrintAt(0, 0, "abcdefghij")
+	PrintAt(0, 1, "abcdefghij")
+	PopClip()
+	if got := rowText(0); got != "  cdef    " {
+		t.Errorf("row 0 = %q, want %q", got, "  cdef    ")
+	}
+	if got := rowText(1); got != "          " {
+		t.Errorf("row 1 = %q, want it untouched", got)
+	}
+
+	PrintAt(8, 1, "xyz")
+	if got := rowText(1); got != "        xy" {
+		t.Errorf("after PopClip row 1 = %q, want %q", got, "        xy")
+	}
+}
+
+func TestNestedOffsets(t *testing.T) {
+	resetTerm(t, 10, 5)
+	PushOffset(2, 1)
+	PushOffset(3, 2)
+	SetCell(0, 0, 'a', 7, 0)
+	SetCursor(1, 0)
+	x, y := CursorPos()
+	PopOffset()
+	SetCell(0, 0, 'b', 7, 0)
+	PopOffset()
+	SetCell(0, 0, 'c', 7, 0)
+
+	if got := term.buffer.Cells[3][5].Ch; got != 'a' {
+		t.Errorf("cell 5,3 = %q, want 'a' from offsets 2,1 + 3,2", got)
+	}
+	if got := term.buffer.Cells[1][2].Ch; got != 'b' {
+		t.Errorf("cell 2,1 = %q, want 'b' after one PopOffset", got)
+	}
+	if got := term.buffer.Cells[0][0].Ch; got != 'c' {
+		t.Errorf("cell 0,0 = %q, want 'c' with no offset", got)
+	}
+	if term.cursorX != 6 || term.cursorY != 3 || x != 1 || y != 0 {
+		t.Errorf("cursor at %d,%d (local %d,%d), want 6,3 (local 1,0)", term.cursorX, term.cursorY, x, y)
+	}
+}
+
+func TestInvalidateRepaints(t *testing.T) {
+	resetTerm(t, 4, 2)
+	PrintAt(0, 0, "ab")
+	PrintAt(1, 1, "cd")
+	capturePresent(t)
+	if got := string(capturePresent(t)); got != "" {
+		t.Fatalf("Present with nothing changed wrote %q", got)
+	}
+
+	Invalidate()
+	got := string(capturePresent(t))
+	for _, want := range []string{"\x1b[1;1H", "ab", "\x1b[2;1H", "cd"} {
+		if !bytes.Contains([]byte(got), []byte(want)) {
+			t.Errorf("Present after Invalidate wrote %q, missing %q", got, want)
+		}
+	}
+	if term.stats.CellsWritten != 8 {
+		t.Errorf("Present after Invalidate wrote %d cells, want all 8", term.stats.CellsWritten)
+	}
+}
+
+func TestX10MouseBounds(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Event
+	}{
+		{"\x1b[M\x20\x21\x21", Event{Type: EventMouse, Button: MouseLeft, X: 0, Y: 0, Press: true}},
+		{"\x1b[M\x22\xff\xff", Event{Type: EventMouse, Button: MouseRight, X: 222, Y: 222, Press: true}},
+		{"\x1b[M\x23\x30\x40", Event{Type: EventMouse, Button: MouseLeft, X: 15, Y: 31}},
+		{"\x1b[M\x60\x21\x21", Event{Type: EventMouse, Button: MouseWheelUp, X: 0, Y: 0, Press: true}},
+	}
+	for _, tt := range tests {
+		evt, n, err := parseInput([]byte(tt.in))
+		if err != nil || n != 6 || !reflect.DeepEqual(evt, tt.want) {
+			t.Errorf("parseInput(%q) = %+v, %d, %v; want %+v", tt.in, evt, n, err, tt.want)
+		}
+	}
+
+	// Past column or row 223 xterm sends a zero byte instead of a position.
+	for _, in := range []string{"\x1b[M\x20\x00\x21", "\x1b[M\x20\x21\x00", "\x1b[M\x20\x20\x21"} {
+		if _, _, err := parseInput([]byte(in)); err == nil {
+			t.Errorf("parseInput(%q) accepted an out-of-range position", in)
+		}
+		events := parseEvents([]byte(in + "a"))
+		if len(events) != 2 || events[0].Type != EventUnknown || string(events[0].Raw) != in || events[1].Ch != 'a' {
+			t.Errorf("parseEvents(%q) = %+v, want EventUnknown with the report then 'a'", in, events)
+		}
+	}
+}
+
+func TestScrollFillsBackground(t *testing.T) {
+	resetTerm(t, 2, 3)
+	for y, s := range []string{"aa", "bb", "cc"} {
+		PrintAt(0, y, s)
+	}
+	SetColor(3, 4)
+	Scroll(-1)
+	if rowText(0) != "bb" || rowText(1) != "cc" {
+		t.Errorf("rows after Scroll(-1) = %q, %q; want bb, cc", rowText(0), rowText(1))
+	}
+	for _, c := range term.buffer.Cells[2] {
+		if c.Ch != ' ' || c.Fg != 3 || c.Bg != 4 {
+			t.Errorf("scrolled-in cell = %q fg %d bg %d, want blank in 3/4", c.Ch, c.Fg, c.Bg)
+		}
+	}
+
+	ScrollFill(1, 7, 5)
+	if rowText(1) != "bb" {
+		t.Errorf("row 1 after ScrollFill(1) = %q, want bb", rowText(1))
+	}
+	for _, c := range term.buffer.Cells[0] {
+		if c.Bg != 5 {
+			t.Errorf("row 0 bg = %d after ScrollFill(1, 7, 5), want 5", c.Bg)
+		}
+	}
+
+	ScrollFill(-10, 7, 6)
+	for y := 0; y < 3; y++ {
+		if rowText(y) != "  " || term.buffer.Cells[y][0].Bg != 6 {
+			t.Errorf("row %d = %q bg %d after scrolling everything away", y, rowText(y), term.buffer.Cells[y][0].Bg)
+		}
+	}
+}
+
+func TestDrawRunesWide(t *testing.T) {
+	resetTerm(t, 6, 1)
+	DrawRunes(0, 0, []rune("a世́b"), 2, 0)
+	want := []Cell{{Ch: 'a'}, {Ch: '世'}, {Cont: true}, {Ch: 'b'}, {Ch: ' '}}
+	for x, w := range want {
+		c := term.buffer.Cells[0][x]
+		if c.Ch != w.Ch || c.Cont != w.Cont {
+			t.Errorf("cell %d = %q cont %v, want %q cont %v", x, c.Ch, c.Cont, w.Ch, w.Cont)
+		}
+	}
+
+	// A wide rune that doesn't fit before the edge is left out whole.
+	DrawRunes(4, 0, []rune("x世"), 2, 0)
+	if c := term.buffer.Cells[0][5]; c.Ch != ' ' || c.Cont {
+		t.Errorf("last cell = %q cont %v, want it blank", c.Ch, c.Cont)
+	}
+}
+
+func benchmarkLine(b *testing.B, draw func(y int, line string)) {
+	term = Terminal{width: 80, height: 24}
+	term.buffer = initBuffer(term.width, term.height)
+	term.backBuffer = initBuffer(term.width, term.height)
+	b.Cleanup(func() { term = Terminal{} })
+	line := ""
+	for len(line) < term.width {
+		line += "the quick brown fox "
+	}
+	line = line[:term.width]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for y := 0; y < term.height; y++ {
+			draw(y, line)
+		}
+	}
+}
+
+func BenchmarkDrawRunes(b *testing.B) {
+	var runes []rune
+	benchmarkLine(b, func(y int, line string) {
+		if runes == nil {
+			runes = []rune(line)
+		}
+		DrawRunes(0, y, runes, 7, 0)
+	})
+}
+
+func BenchmarkPrintAtLine(b *testing.B) {
+	benchmarkLine(b, func(y int, line string) {
+		PrintAt(0, y, line)
+	})
+}
+
+func TestPrintAtGraphemes(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster string
+		width   int
+	}{
+		{"combining mark", "é", 1},
+		{"skin tone", "\U0001F44D\U0001F3FD", 2},
+		{"flag", "\U0001F1EF\U0001F1F5", 2},
+		{"zwj family", "\U0001F468‍\U0001F469‍\U0001F467", 2},
+		{"wide cjk", "世", 2},
+	}
+	for _, tt := range tests {
+		cluster, width, rest := nextGrapheme(tt.cluster + "x")
+		if cluster != tt.cluster || width != tt.width || rest != "x" {
+			t.Errorf("%s: nextGrapheme = %q, %d, %q; want %q, %d, \"x\"", tt.name, cluster, width, rest, tt.cluster, tt.width)
+		}
+
+		resetTerm(t, 4, 1)
+		PrintAt(0, 0, tt.cluster+"x")
+		row := term.buffer.Cells[0]
+		runes := []rune(tt.cluster)
+		wantSeq := ""
+		if len(runes) > 1 {
+			wantSeq = tt.cluster
+		}
+		if row[0].Ch != runes[0] || row[0].Seq != wantSeq {
+			t.Errorf("%s: lead cell = %q seq %q, want %q seq %q", tt.name, row[0].Ch, row[0].Seq, runes[0], wantSeq)
+		}
+		for x := 1; x < tt.width; x++ {
+			if !row[x].Cont {
+				t.Errorf("%s: cell %d is not a continuation", tt.name, x)
+			}
+		}
+		if row[tt.width].Ch != 'x' || row[tt.width].Cont {
+			t.Errorf("%s: 'x' not at column %d: %+v", tt.name, tt.width, row[tt.width])
+		}
+	}
+}
+
+// pipeInput points inFd at a pipe for the rest of the test and returns the
+// end to write keystrokes to.
+func pipeInput(t *testing.T) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := inFd
+	inFd = int(r.Fd())
+	t.Cleanup(func() {
+		inFd = saved
+		r.Close()
+		w.Close()
+	})
+	return w
+}
+
+func TestPollEventNowIncomplete(t *testing.T) {
+	resetTerm(t, 10, 2)
+	term.escDelay = 200
+	in := pipeInput(t)
+
+	for _, tt := range []struct {
+		head, tail string
+		want       Event
+	}{
+		{"\x1b", "[A", Event{Type: EventKey, Key: KeyArrowUp}},
+		{"\x1b[1;", "5B", Event{Type: EventKey, Key: KeyArrowDown, Mod: ModCtrl}},
+	} {
+		in.WriteString(tt.head)
+		start := time.Now()
+		if evt, ok := PollEventNow(); ok {
+			t.Errorf("PollEventNow after %q = %+v, want nothing yet", tt.head, evt)
+		}
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Errorf("PollEventNow after %q took %v", tt.head, d)
+		}
+
+		in.WriteString(tt.tail)
+		evt, ok := PollEventNow()
+		if !ok || evt.Type != tt.want.Type || evt.Key != tt.want.Key || evt.Mod != tt.want.Mod {
+			t.Errorf("PollEventNow after %q = %+v, %v; want %+v", tt.head+tt.tail, evt, ok, tt.want)
+		}
+	}
+
+	// A lone ESC is a key press once escDelay has passed without more input.
+	in.WriteString("\x1b")
+	if _, ok := PollEventNow(); ok {
+		t.Fatal("lone ESC decoded before escDelay")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if evt, ok := PollEventNow(); !ok || evt.Key != KeyEscape {
+		t.Errorf("PollEventNow after escDelay = %+v, %v; want Escape", evt, ok)
+	}
+}
+
+func TestManualFlushHoldsModes(t *testing.T) {
+	resetTerm(t, 4, 1)
+	SetFlushMode(ManualFlush)
+	got := captureOutput(t, func() {
+		SetCursorVisible(true)
+		SetCursorStyle(CursorLine)
+		EnableMouse()
+	})
+	if len(got) != 0 {
+		t.Errorf("wrote %q before Flush", got)
+	}
+
+	want := ShowCursor + "\x1b[" + strconv.Itoa(CursorLine) + " q" + EnableMouseMode
+	if got := string(captureOutput(t, Flush)); got != want {
+		t.Errorf("Flush wrote %q, want %q", got, want)
+	}
+}
+
+func TestParseFocus(t *testing.T) {
+	for in, focused := range map[string]bool{"\x1b[I": true, "\x1b[O": false} {
+		evt, n, err := parseInput([]byte(in))
+		if err != nil || n != 3 || evt.Type != EventFocus || evt.Focused != focused {
+			t.Errorf("parseInput(%q) = %+v, %d, %v; want EventFocus focused=%v", in, evt, n, err, focused)
+		}
+	}
+}
+
+func TestParseUnknownCSI(t *testing.T) {
+	in := "\x1b[99;1z"
+	events := parseEvents([]byte(in + "q"))
+	if len(events) != 2 {
+		t.Fatalf("parseEvents(%q) = %+v, want two events", in+"q", events)
+	}
+	if events[0].Type != EventUnknown || string(events[0].Raw) != in {
+		t.Errorf("unknown CSI = %+v, want EventUnknown with Raw %q", events[0], in)
+	}
+	if events[1].Type != EventKey || events[1].Ch != 'q' {
+		t.Errorf("after the unknown CSI got %+v, want 'q'", events[1])
+	}
+}
+
+func TestPromptWordMotion(t *testing.T) {
+	var p Prompt
+	p.SetValue("foo, bar  baz.qux")
+	left := []int{10, 5, 0, 0}
+	for i, want := range left {
+		mod := ModCtrl
+		if i%2 == 1 {
+			mod = ModAlt
+		}
+		p.Feed(Event{Type: EventKey, Key: KeyArrowLeft, Mod: mod})
+		if p.pos != want {
+			t.Errorf("word left %d landed at %d, want %d", i+1, p.pos, want)
+		}
+	}
+	for i, want := range []int{4, 8, 17, 17} {
+		p.Feed(Event{Type: EventKey, Key: KeyArrowRight, Mod: ModCtrl})
+		if p.pos != want {
+			t.Errorf("word right %d landed at %d, want %d", i+1, p.pos, want)
+		}
+	}
+	p.Feed(Event{Type: EventKey, Key: KeyArrowLeft})
+	if p.pos != 16 {
+		t.Errorf("plain left landed at %d, want 16", p.pos)
+	}
+}
+
+func TestHitTest(t *testing.T) {
+	tests := []struct {
+		x, y int
+		want bool
+	}{
+		{2, 3, true}, {5, 4, true}, {1, 3, false}, {6, 3, false},
+		{2, 2, false}, {2, 5, false}, {6, 5, false},
+	}
+	for _, tt := range tests {
+		evt := Event{Type: EventMouse, X: tt.x, Y: tt.y, Press: true}
+		if got := HitTest(evt, 2, 3, 4, 2); got != tt.want {
+			t.Errorf("HitTest at %d,%d = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+	if HitTest(Event{Type: EventKey, X: 3, Y: 3}, 2, 3, 4, 2) {
+		t.Error("HitTest accepted a key event")
+	}
+	if HitTest(Event{Type: EventMouse, X: 2, Y: 3}, 2, 3, 0, 2) {
+		t.Error("HitTest hit an empty rectangle")
+	}
+}
+
+func TestClickCount(t *testing.T) {
+	resetTerm(t, 10, 5)
+	press := func(x, y int) int {
+		evt, _ := filterEvent(Event{Type: EventMouse, Button: MouseLeft, X: x, Y: y, Press: true})
+		return evt.Clicks
+	}
+	release := func(x, y int) {
+		filterEvent(Event{Type: EventMouse, Button: MouseLeft, X: x, Y: y})
+	}
+
+	for i, want := range []int{1, 2, 3} {
+		if got := press(4, 2); got != want {
+			t.Errorf("press %d counted %d clicks, want %d", i+1, got, want)
+		}
+		release(4, 2)
+	}
+	if got := press(5, 2); got != 1 {
+		t.Errorf("press on another cell counted %d clicks, want 1", got)
+	}
+	if got := press(6, 2); got != 1 {
+		t.Errorf("drag report counted %d clicks, want the press's 1", got)
+	}
+	release(6, 2)
+
+	press(5, 2)
+	release(5, 2)
+	term.lastClickAt = term.lastClickAt.Add(-clickWindow - time.Millisecond)
+	if got := press(5, 2); got != 1 {
+		t.Errorf("press after clickWindow counted %d clicks, want 1", got)
+	}
+}
+
+func TestKeyRepeatCoalesce(t *testing.T) {
+	resetTerm(t, 10, 2)
+	in := pipeInput(t)
+
+	SetKeyRepeatMode(KeyRepeatCoalesce)
+	in.WriteString("aaab")
+	if evt, err := PollEvent(); err != nil || evt.Ch != 'a' || evt.Repeat != 2 {
+		t.Errorf("first event = %+v, %v; want 'a' with Repeat 2", evt, err)
+	}
+	if evt, err := PollEvent(); err != nil || evt.Ch != 'b' || evt.Repeat != 0 {
+		t.Errorf("second event = %+v, %v; want 'b'", evt, err)
+	}
+
+	SetKeyRepeatMode(KeyRepeatAll)
+	in.WriteString("aa")
+	for i := 0; i < 2; i++ {
+		if evt, err := PollEvent(); err != nil || evt.Ch != 'a' || evt.Repeat != 0 {
+			t.Errorf("event %d with coalescing off = %+v, %v; want a plain 'a'", i+1, evt, err)
+		}
+	}
+}
+
+func TestSetBgRegionKeepsGlyphs(t *testing.T) {
+	resetTerm(t, 4, 2)
+	Bold(true)
+	SetCell(1, 0, 'x', 3, 0)
+	Bold(false)
+	PrintAt(2, 0, "世")
+	SetBgRegion(0, 0, 4, 1, 6)
+
+	row := term.buffer.Cells[0]
+	if row[1].Ch != 'x' || row[1].Fg != 3 || !row[1].Bold {
+		t.Errorf("cell 1 = %+v, want bold 'x' in 3 kept", row[1])
+	}
+	if row[2].Ch != '世' || !row[3].Cont {
+		t.Errorf("wide cell lost: %+v %+v", row[2], row[3])
+	}
+	for x, c := range row {
+		if c.Bg != 6 {
+			t.Errorf("cell %d bg = %d, want 6", x, c.Bg)
+		}
+	}
+	if term.buffer.Cells[1][0].Bg != 0 {
+		t.Error("SetBgRegion painted outside its rectangle")
+	}
+}
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"the quick brown fox", 10, []string{"the quick", "brown fox"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"a\n\nb", 10, []string{"a", "", "b"}},
+		{"one two", 0, []string{"one two"}},
+		{"日本語です", 4, []string{"日本", "語で", "す"}},
+	}
+	for _, tt := range tests {
+		if got := wrapText(tt.text, tt.width); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+
+	if w, h := MeasureText("the quick brown fox", 10); w != 9 || h != 2 {
+		t.Errorf("MeasureText = %d, %d; want 9, 2", w, h)
+	}
+}
+
+func TestDrawTextAlign(t *testing.T) {
+	resetTerm(t, 12, 3)
+	s := Style{Fg: 7, Bg: 0}
+	rect := Rect{X: 1, Y: 0, W: 9, H: 2}
+	tests := []struct {
+		align Align
+		rows  []string
+	}{
+		{AlignLeft, []string{" ab cd     ", " efghij    "}},
+		{AlignCenter, []string{"   ab cd   ", "  efghij   "}},
+		{AlignRight, []string{"     ab cd ", "    efghij "}},
+	}
+	for _, tt := range tests {
+		Clear()
+		if over := DrawText(rect, "ab cd efghij", s, tt.align); over != 0 {
+			t.Errorf("align %v: %d lines overflowed, want 0", tt.align, over)
+		}
+		for y, want := range tt.rows {
+			if got := rowText(y)[:11]; got != want {
+				t.Errorf("align %v row %d = %q, want %q", tt.align, y, got, want)
+			}
+		}
+	}
+
+	Clear()
+	if over := DrawText(Rect{X: 0, Y: 0, W: 4, H: 2}, "one two six ten", s, AlignLeft); over != 2 {
+		t.Errorf("overflow = %d, want 2", over)
+	}
+	if rowText(0)[:5] != "one  " || rowText(1)[:5] != "two  " || rowText(2) != "            " {
+		t.Errorf("clipped rows = %q, %q, %q", rowText(0), rowText(1), rowText(2))
+	}
+}
+
+func TestPresentSyncBracket(t *testing.T) {
+	resetTerm(t, 4, 1)
+	term.syncProbed, term.syncSupported = true, true
+	SetSyncMode(true)
+	PrintAt(0, 0, "ab")
+	got := string(capturePresent(t))
+	if !bytes.HasPrefix([]byte(got), []byte("\x1b[?2026h")) || !bytes.HasSuffix([]byte(got), []byte("\x1b[?2026l")) {
+		t.Errorf("Present wrote %q, want it inside ESC[?2026h ... ESC[?2026l", got)
+	}
+	if got := string(capturePresent(t)); got != "" {
+		t.Errorf("Present with nothing to draw wrote %q", got)
+	}
+
+	term.syncSupported = false
+	SetSyncMode(true)
+	PrintAt(0, 0, "cd")
+	if got := string(capturePresent(t)); bytes.Contains([]byte(got), []byte("2026")) {
+		t.Errorf("Present on a terminal without mode 2026 wrote %q", got)
+	}
+}
+
+func TestKeyMapCtrlByte(t *testing.T) {
+	var km KeyMap
+	km.Bind("save", MatchCtrl('s'))
+	km.Bind("quit", MatchCtrl('C'))
+	for in, want := range map[string]string{"\x13": "save", "\x03": "quit"} {
+		evt, _, err := parseInput([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action, ok := km.Lookup(evt); !ok || action != want {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", in, action, ok, want)
+		}
+	}
+	if action, ok := km.Lookup(Event{Type: EventKey, Ch: 's'}); ok {
+		t.Errorf("plain 's' resolved to %q", action)
+	}
+}
+
+func TestParseStackedMouse(t *testing.T) {
+	events := parseEvents([]byte("\x1b[<0;5;3M\x1b[<0;5;3m"))
+	want := []Event{
+		{Type: EventMouse, Button: MouseLeft, X: 4, Y: 2, Press: true},
+		{Type: EventMouse, Button: MouseLeft, X: 4, Y: 2},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("parseEvents = %+v, want %+v", events, want)
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Event
+		n    int
+	}{
+		{"a", Event{Type: EventKey, Ch: 'a'}, 1},
+		{"é", Event{Type: EventKey, Ch: 'é'}, 2},
+		{"\r", Event{Type: EventKey, Key: KeyEnter}, 1},
+		{"\n", Event{Type: EventKey, Key: KeyEnter}, 1},
+		{"\x01", Event{Type: EventKey, Key: KeyCtrlA}, 1},
+		{"\x1b", Event{Type: EventKey, Key: KeyEscape}, 1},
+		{"\x1b\x1b", Event{Type: EventKey, Key: KeyEscape}, 1},
+		{"\x1bx", Event{Type: EventKey, Ch: 'x', Mod: ModAlt}, 2},
+		{"\x1b[A", Event{Type: EventKey, Key: KeyArrowUp}, 3},
+		{"\x1bOP", Event{Type: EventKey, Key: KeyF1}, 3},
+		{"\x1b[1;5C", Event{Type: EventKey, Key: KeyArrowRight, Mod: ModCtrl}, 6},
+		{"\x1b[3~x", Event{Type: EventKey, Key: KeyDelete}, 4},
+	}
+	for _, tt := range tests {
+		evt, n, err := parseInput([]byte(tt.in))
+		if err != nil {
+			t.Errorf("parseInput(%q): %v", tt.in, err)
+			continue
+		}
+		evt.Raw = nil
+		if n != tt.n || !reflect.DeepEqual(evt, tt.want) {
+			t.Errorf("parseInput(%q) = %+v, %d; want %+v, %d", tt.in, evt, n, tt.want, tt.n)
+		}
+	}
+}
+
+func TestParseInputIncomplete(t *testing.T) {
+	for _, in := range []string{"\x1b[", "\x1b[1;5", "\x1b[<0;1", "\xc3"} {
+		if _, _, err := parseInput([]byte(in)); err != errIncomplete {
+			t.Errorf("parseInput(%q) error = %v, want errIncomplete", in, err)
+		}
+	}
+}
+
+func TestEscapeLength(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"\x1b[A", 3},
+		{"\x1b[1;5Cx", 6},
+		{"\x1b[M abc", 6},
+		{"\x1b[M a", 0},
+		{"\x1b[<0;10;5M", 10},
+		{"\x1bOP", 3},
+		{"\x1b[200~", 6},
+	}
+	for _, tt := range tests {
+		if got := escapeLength([]byte(tt.in)); got != tt.want {
+			t.Errorf("escapeLength(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseEventsConcatenated(t *testing.T) {
+	in := "a\x1b[A\x1b[<0;2;2Mé\x1b[3~\x1b[<64;1;1M\x01"
+	want := []Event{
+		{Type: EventKey, Ch: 'a'},
+		{Type: EventKey, Key: KeyArrowUp},
+		{Type: EventMouse, Button: MouseLeft, X: 1, Y: 1, Press: true, Clicks: 1},
+		{Type: EventKey, Ch: 'é'},
+		{Type: EventKey, Key: KeyDelete},
+		{Type: EventMouse, Button: MouseWheelUp, X: 0, Y: 0, Press: true},
+		{Type: EventKey, Key: KeyCtrlA},
+	}
+	events := parseEvents([]byte(in))
+	for i := range events {
+		events[i].Raw = nil
+		events[i], _ = filterEvent(events[i])
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("parseEvents(%q) =\n%+v\nwant\n%+v", in, events, want)
+	}
+
+	// PollEvent hands out the rest of one read before reading again.
+	resetTerm(t, 10, 2)
+	pipeInput(t).WriteString(in)
+	for i, w := range want {
+		evt, err := PollEvent()
+		evt.Raw = nil
+		if err != nil || !reflect.DeepEqual(evt, w) {
+			t.Errorf("PollEvent %d = %+v, %v; want %+v", i+1, evt, err, w)
+		}
+	}
+}
+
+func TestScrollThumb(t *testing.T) {
+	tests := []struct {
+		track, total, visible, offset int
+		start, size                   int
+	}{
+		{10, 5, 10, 0, 0, 10},    // everything fits: full thumb
+		{10, 0, 0, 0, 0, 10},     // nothing to scroll
+		{10, 100, 20, 0, 0, 2},   // top
+		{10, 100, 20, 40, 4, 2},  // middle
+		{10, 100, 20, 80, 8, 2},  // bottom
+		{10, 100, 20, 500, 8, 2}, // past the end clamps
+		{10, 100, 20, -5, 0, 2},  // before the start clamps
+		{10, 1000, 5, 995, 9, 1}, // thumb never shrinks below one cell
+	}
+	for _, tt := range tests {
+		start, size := scrollThumb(tt.track, tt.total, tt.visible, tt.offset)
+		if start != tt.start || size != tt.size {
+			t.Errorf("scrollThumb(%d, %d, %d, %d) = %d, %d; want %d, %d",
+				tt.track, tt.total, tt.visible, tt.offset, start, size, tt.start, tt.size)
+		}
+	}
+
+	resetTerm(t, 2, 4)
+	SetLineDrawingMode(LineDrawingASCII)
+	DrawScrollbar(1, 0, 4, 8, 4, 4)
+	var col string
+	for y := 0; y < 4; y++ {
+		col += string(term.buffer.Cells[y][1].Ch)
+	}
+	if col != "||##" {
+		t.Errorf("scrollbar column = %q, want %q", col, "||##")
+	}
+}
+
+func TestSetBoxChars(t *testing.T) {
+	resetTerm(t, 4, 3)
+	SetLineDrawingMode(LineDrawingUnicode)
+	SetBoxChars('1', '2', '3', '4', '=', '!')
+	Box(0, 0, 4, 3)
+	for y, want := range []string{"1==2", "!  !", "3==4"} {
+		if got := rowText(y); got != want {
+			t.Errorf("custom row %d = %q, want %q", y, got, want)
+		}
+	}
+
+	ResetBoxChars()
+	Box(0, 0, 4, 3)
+	for y, want := range []string{"┌──┐", "│  │", "└──┘"} {
+		if got := rowText(y); got != want {
+			t.Errorf("reset row %d = %q, want %q", y, got, want)
+		}
+	}
+}
+
+func TestAltScreenCursorVisibility(t *testing.T) {
+	for _, visible := range []bool{false, true} {
+		resetTerm(t, 4, 2)
+		term.initialized, term.altScreen, term.startKnown = true, true, true
+		term.cursorVisible = visible
+
+		out := string(captureOutput(t, LeaveAltScreen))
+		if !contains(out, ShowCursor, NormalScreen) || !term.cursorVisible {
+			t.Errorf("visible=%v: LeaveAltScreen wrote %q, want the cursor shown", visible, out)
+		}
+		out = string(captureOutput(t, EnterAltScreen))
+		if hid := bytes.Contains([]byte(out), []byte(HideCursor)); hid == visible {
+			t.Errorf("visible=%v: EnterAltScreen wrote %q", visible, out)
+		}
+		if term.cursorVisible != visible {
+			t.Errorf("visible=%v: cursorVisible = %v after a round trip", visible, term.cursorVisible)
+		}
+	}
+}
+
+func TestFadeRegion(t *testing.T) {
+	if got := BlendColor([3]int{0, 100, 255}, [3]int{200, 0, 55}, 0.5); got != [3]int{100, 50, 155} {
+		t.Errorf("BlendColor at 0.5 = %v, want [100 50 155]", got)
+	}
+
+	toward := [3]int{200, 100, 50}
+	tests := []struct {
+		t    float64
+		want int
+	}{
+		{0, RGBColor(0, 0, 0)},
+		{-1, RGBColor(0, 0, 0)},
+		{0.5, RGBColor(100, 50, 25)},
+		{1, RGBColor(200, 100, 50)},
+		{2, RGBColor(200, 100, 50)},
+	}
+	for _, tt := range tests {
+		resetTerm(t, 2, 1)
+		term.buffer.Cells[0][0].Bg = RGBColor(0, 0, 0)
+		term.buffer.Cells[0][0].Dirty = false
+		FadeRegion(0, 0, 1, 1, toward, tt.t)
+		c := term.buffer.Cells[0][0]
+		if c.Bg != tt.want {
+			t.Errorf("t=%v: bg = %#x, want %#x", tt.t, c.Bg, tt.want)
+		}
+		if c.Dirty != (tt.t > 0) {
+			t.Errorf("t=%v: dirty = %v", tt.t, c.Dirty)
+		}
+	}
+
+	// A palette background that is already at the target keeps its index.
+	resetTerm(t, 1, 1)
+	term.buffer.Cells[0][0].Dirty = false
+	FadeRegion(0, 0, 1, 1, [3]int{0, 0, 0}, 0.5)
+	if c := term.buffer.Cells[0][0]; c.Bg != 0 || c.Dirty {
+		t.Errorf("unchanged cell = bg %#x dirty %v, want palette 0 untouched", c.Bg, c.Dirty)
+	}
+}
+
+func TestPresentOutput(t *testing.T) {
+	resetTerm(t, 3, 1)
+	term.buffer.Cells[0][1] = Cell{Ch: 'x', Fg: 2, Bg: 0, UnderColor: -1, Dirty: true}
+	term.backBuffer.Cells[0][0] = term.buffer.Cells[0][0]
+	term.backBuffer.Cells[0][2] = term.buffer.Cells[0][2]
+
+	got := string(capturePresent(t))
+	want := "\x1b[1;2H\x1b[38;5;2m\x1b[48;5;0mx" + ResetColor
+	if got != want {
+		t.Errorf("Present wrote %q, want %q", got, want)
+	}
+	if got := string(capturePresent(t)); got != "" {
+		t.Errorf("second Present wrote %q, want nothing", got)
+	}
+}
+
+func TestPresentEraseLine(t *testing.T) {
+	resetTerm(t, 10, 1)
+	for x := 0; x < 10; x++ {
+		term.backBuffer.Cells[0][x].Ch = 'z'
+	}
+	SetCell(0, 0, 'a', 7, 0)
+
+	got := string(capturePresent(t))
+	want := "\x1b[1;1H\x1b[38;5;7m\x1b[48;5;0ma\x1b[K" + ResetColor
+	if got != want {
+		t.Errorf("Present wrote %q, want %q", got, want)
+	}
+	for x := 0; x < 10; x++ {
+		if !term.backBuffer.Cells[0][x].Equal(term.buffer.Cells[0][x]) {
+			t.Fatalf("back buffer cell %d not updated", x)
+		}
+	}
+}
+
+func TestClearPaintsDefaultCell(t *testing.T) {
+	saved := defaultCell
+	t.Cleanup(func() { defaultCell = saved })
+
+	resetTerm(t, 3, 2)
+	PrintAt(0, 0, "abc")
+	SetDefaultCell('.', 3, 236)
+	Clear()
+	for y := 0; y < 2; y++ {
+		for x, c := range term.buffer.Cells[y] {
+			if c.Ch != '.' || c.Fg != 3 || c.Bg != 236 {
+				t.Errorf("cell %d,%d = %q %d/%d after Clear, want '.' 3/236", x, y, c.Ch, c.Fg, c.Bg)
+			}
+		}
+	}
+	if b := initBuffer(1, 1); b.Cells[0][0].Bg != 236 {
+		t.Errorf("new buffer bg = %d, want the default 236", b.Cells[0][0].Bg)
+	}
+}
+
+func TestCellWriterSGR(t *testing.T) {
+	tests := []struct {
+		params string
+		want   Style
+	}{
+		{"1;31", Style{Fg: 1, Bg: 0, Bold: true}},
+		{"38;5;200;48;5;17", Style{Fg: 200, Bg: 17}},
+		{"38:5:200", Style{Fg: 200, Bg: 0}},
+		{"38;2;255;0;0", Style{Fg: RGBColor(255, 0, 0), Bg: 0}},
+		{"38:2::255:0:0", Style{Fg: RGBColor(255, 0, 0), Bg: 0}},
+		{"4:0", Style{Fg: 7, Bg: 0}},
+		{"4:3;7", Style{Fg: 7, Bg: 0, Under: true, Rev: true}},
+		{"1;0", Style{Fg: 7, Bg: 0}},
+		{"38;31;1", Style{Fg: 1, Bg: 0, Bold: true}},
+		{"1;38;5", Style{Fg: 7, Bg: 0, Bold: true}},
+		{"48;2;1;2;3", Style{Fg: 7, Bg: RGBColor(1, 2, 3)}},
+	}
+	for _, tt := range tests {
+		w := &CellWriter{style: Style{Fg: 7, Bg: 0}, base: Style{Fg: 7, Bg: 0}, started: true}
+		w.sgr(tt.params)
+		if w.style != tt.want {
+			t.Errorf("sgr(%q) = %+v, want %+v", tt.params, w.style, tt.want)
+		}
+		if got := CurrentStyle(); got != tt.want {
+			t.Errorf("sgr(%q) left the current style at %+v", tt.params, got)
+		}
+	}
+}
+
+func TestCellWriterColors(t *testing.T) {
+	resetTerm(t, 10, 1)
+	SetColor(7, 0)
+	w := &CellWriter{Rect: Rect{W: 10, H: 1}}
+	w.Write([]byte("a\x1b[1;31mb\x1b[38;2;9;8;7;44mc\x1b[0md\x1b[2Je"))
+	if got := rowText(0)[:5]; got != "abcde" {
+		t.Fatalf("row = %q, want the text without escapes", got)
+	}
+	row := term.buffer.Cells[0]
+	want := []struct {
+		fg, bg int
+		bold   bool
+	}{{7, 0, false}, {1, 0, true}, {RGBColor(9, 8, 7), 4, true}, {7, 0, false}, {7, 0, false}}
+	for x, w := range want {
+		if c := row[x]; c.Fg != w.fg || c.Bg != w.bg || c.Bold != w.bold {
+			t.Errorf("cell %d = fg %#x bg %d bold %v, want fg %#x bg %d bold %v", x, c.Fg, c.Bg, c.Bold, w.fg, w.bg, w.bold)
+		}
+	}
+	if s := CurrentStyle(); s.Fg != 7 || s.Bold {
+		t.Errorf("Write left the current style at %+v", s)
+	}
+}
+
+func TestChordMatcher(t *testing.T) {
+	var cm ChordMatcher
+	cm.Bind("save", MatchCtrl('x'), MatchCtrl('s'))
+	cm.Bind("quit", MatchCtrl('x'), MatchCtrl('c'))
+	ctrl := func(ch rune) Event { return Event{Type: EventKey, Ch: ch - 'a' + 1} }
+
+	if _, ok := cm.Feed(ctrl('x')); ok || !cm.Pending() {
+		t.Fatal("Ctrl+X didn't start a chord")
+	}
+	if action, ok := cm.Feed(Event{Type: EventKey, Ch: 's', Mod: ModCtrl}); !ok || action != "save" {
+		t.Errorf("Ctrl+X Ctrl+S = %q, %v; want save", action, ok)
+	}
+	if cm.Pending() {
+		t.Error("chord still pending after it resolved")
+	}
+
+	// A key that continues no chord resets; the next chord starts clean.
+	cm.Feed(ctrl('x'))
+	if action, ok := cm.Feed(Event{Type: EventKey, Ch: 'q'}); ok || cm.Pending() {
+		t.Errorf("Ctrl+X q = %q, %v, pending %v; want a reset", action, ok, cm.Pending())
+	}
+	if action, ok := cm.Feed(ctrl('s')); ok {
+		t.Errorf("Ctrl+S alone resolved to %q", action)
+	}
+	cm.Feed(ctrl('x'))
+	if action, ok := cm.Feed(ctrl('c')); !ok || action != "quit" {
+		t.Errorf("Ctrl+X Ctrl+C after a mistype = %q, %v; want quit", action, ok)
+	}
+
+	// Keys further apart than Timeout don't join up.
+	cm.Timeout = time.Millisecond
+	cm.Feed(ctrl('x'))
+	time.Sleep(5 * time.Millisecond)
+	if action, ok := cm.Feed(ctrl('s')); ok {
+		t.Errorf("chord resolved to %q across the timeout", action)
+	}
+}
+
+func TestGetCursorPosKeepsKeys(t *testing.T) {
+	resetTerm(t, 10, 10)
+	term.initialized = true
+	discardOutput(t)
+	pipeInput(t).WriteString("x\x1b[5;7Ry")
+
+	if x, y := GetCursorPos(); x != 6 || y != 4 {
+		t.Errorf("GetCursorPos = %d, %d; want 6, 4", x, y)
+	}
+	for _, want := range []rune{'x', 'y'} {
+		evt, err := PollEvent()
+		if err != nil || evt.Type != EventKey || evt.Ch != want {
+			t.Errorf("PollEvent = %+v, %v; want the %q typed during the query", evt, err, want)
+		}
+	}
+}
+
+func TestRenderOnce(t *testing.T) {
+	t.Cleanup(func() { term = Terminal{} })
+	t.Setenv("COLUMNS", "4")
+	t.Setenv("LINES", "2")
+
+	var err error
+	out := string(captureOutput(t, func() {
+		err = RenderOnce(func() { PrintAt(1, 1, "hi") })
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(out, ClearScreen) {
+		t.Errorf("RenderOnce cleared the screen: %q", out)
+	}
+	if !contains(out, "\x1b[1;1H\x1b[38;5;7m\x1b[48;5;0m\x1b[K", "\x1b[2;1H hi ") {
+		t.Errorf("RenderOnce wrote %q, want every cell of the frame", out)
+	}
+
+	discardOutput(t)
+	func() {
+		defer func() { recover() }()
+		RenderOnce(func() { panic("draw failed") })
+	}()
+	if term.initialized {
+		t.Error("a panicking draw left the terminal marked initialized")
+	}
+}
+
+func BenchmarkPresentOneCell(b *testing.B) {
+	term = Terminal{width: 200, height: 60}
+	term.buffer = initBuffer(term.width, term.height)
+	term.backBuffer = initBuffer(term.width, term.height)
+	b.Cleanup(func() { term = Terminal{} })
+	discardOutput(b)
+	drawFrame(0)
+	Present()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SetCell(100, 30, rune('a'+i%26), 7, 0)
+		Present()
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	prev := initBuffer(4, 2)
+	next := initBuffer(4, 2)
+	next.Cells[0][1] = Cell{Ch: 'x', Fg: 1, Bg: RGBColor(10, 20, 30), Bold: true, UnderColor: -1, Dirty: true}
+	next.Cells[1][3] = Cell{Ch: 'e', Seq: "é", Fg: 7, Bg: 0, Under: true, UnderStyle: UnderlineCurly, UnderColor: 4}
+
+	changes := Diff(prev, next)
+	if len(changes) != 2 || changes[0].X != 1 || changes[0].Y != 0 || changes[1].X != 3 || changes[1].Y != 1 {
+		t.Fatalf("Diff = %+v", changes)
+	}
+	if changes[0].Cell.Dirty {
+		t.Error("Diff kept the Dirty flag")
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeFrame(&buf, changes); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing")
+	got, err := DecodeFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, changes) {
+		t.Errorf("DecodeFrame = %+v, want %+v", got, changes)
+	}
+	if buf.String() != "trailing" {
+		t.Errorf("DecodeFrame consumed past the frame, left %q", buf.String())
+	}
+
+	if _, err := DecodeFrame(bytes.NewReader([]byte("XYZ\x01\x00"))); err != ErrBadFrame {
+		t.Errorf("DecodeFrame(bad magic) error = %v, want ErrBadFrame", err)
+	}
+}
+
+func TestShadeAndSparkRunes(t *testing.T) {
+	resetTerm(t, 8, 1)
+	SetLineDrawingMode(LineDrawingUnicode)
+	tests := []struct {
+		intensity float64
+		want      rune
+	}{
+		{-1, ' '}, {0, ' '}, {0.19, ' '}, {0.2, '░'}, {0.5, '▒'}, {0.79, '▓'}, {0.8, '█'}, {1, '█'}, {2, '█'}, {math.NaN(), ' '},
+	}
+	for _, tt := range tests {
+		ShadeCell(0, 0, tt.intensity)
+		if got := term.buffer.Cells[0][0].Ch; got != tt.want {
+			t.Errorf("ShadeCell(%v) = %q, want %q", tt.intensity, got, tt.want)
+		}
+	}
+	if GrayColor(0) != 232 || GrayColor(1) != 255 || GrayColor(0.5) != 244 {
+		t.Errorf("GrayColor(0, 0.5, 1) = %d, %d, %d; want 232, 244, 255", GrayColor(0), GrayColor(0.5), GrayColor(1))
+	}
+
+	DrawSparkline(0, 0, []float64{10, 20, 30, 40, 50, 60, 70, 80})
+	if got := rowText(0); got != "▁▂▃▄▅▆▇█" {
+		t.Errorf("sparkline = %q, want every step once", got)
+	}
+	DrawSparkline(0, 0, []float64{5, 5, math.NaN()})
+	if got := rowText(0)[:len("▁▁▁")]; got != "▁▁▁" {
+		t.Errorf("flat sparkline = %q, want the lowest step", got)
+	}
+}
+
+func TestGaugeColor(t *testing.T) {
+	tests := []struct {
+		g    Gauge
+		want int
+	}{
+		{Gauge{Max: 100, Value: 0}, 2},
+		{Gauge{Max: 100, Value: 69}, 2},
+		{Gauge{Max: 100, Value: 70}, 3},
+		{Gauge{Max: 100, Value: 89}, 3},
+		{Gauge{Max: 100, Value: 90}, 1},
+		{Gauge{Max: 100, Value: 150}, 1},
+		{Gauge{Min: 50, Max: 150, Value: 100}, 2},
+		{Gauge{Max: 100, Value: 50, Warn: 0.4, Crit: 0.6}, 3},
+		{Gauge{Max: 100, Value: 60, Warn: 0.4, Crit: 0.6}, 1},
+		{Gauge{Max: 0, Value: 10}, 2},
+	}
+	for _, tt := range tests {
+		if got := tt.g.Color(); got != tt.want {
+			t.Errorf("%+v: Color = %d, want %d", tt.g, got, tt.want)
+		}
+	}
+}
+
+func TestSetSize(t *testing.T) {
+	resetTerm(t, 4, 2)
+	PrintAt(0, 0, "abcd")
+	PrintAt(0, 1, "efgh")
+	term.eventQueue = make([]Event, 0, 8) // as Init leaves it
+	SizeChanged()
+
+	SetSize(6, 1)
+	if w, h := GetTerminalSize(); w != 6 || h != 1 {
+		t.Fatalf("size = %dx%d, want 6x1", w, h)
+	}
+	if got := rowText(0); got != "abcd  " {
+		t.Errorf("row 0 = %q, want the old content kept", got)
+	}
+	evt, ok := PollEventNow()
+	if !ok || evt.Type != EventResize {
+		t.Errorf("PollEventNow = %+v, %v; want EventResize", evt, ok)
+	}
+	select {
+	case <-SizeChanged():
+	default:
+		t.Error("SizeChanged not signalled")
+	}
+
+	SetSize(6, 1)
+	SetSize(0, 5)
+	if _, ok := PollEventNow(); ok {
+		t.Error("an unchanged or invalid size queued an event")
+	}
+}
+
+func TestDrawImageBlocks(t *testing.T) {
+	resetTerm(t, 3, 2)
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	fill := func(x0, y0, x1, y1 int, c color.RGBA) {
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	fill(0, 0, 2, 4, color.RGBA{255, 0, 0, 255})
+	fill(2, 0, 4, 2, color.RGBA{0, 0, 255, 255})
+	fill(2, 2, 4, 4, color.RGBA{0, 100, 0, 255})
+	img.SetRGBA(0, 3, color.RGBA{0, 0, 0, 255})
+
+	// 4x4 pixels onto 2x2 cells: each cell is a 2x1 pixel block over
+	// another, averaged.
+	DrawImageBlocks(1, 0, 2, 2, img)
+	tests := []struct {
+		x, y   int
+		fg, bg int
+	}{
+		{1, 0, RGBColor(255, 0, 0), RGBColor(255, 0, 0)},
+		{2, 0, RGBColor(0, 0, 255), RGBColor(0, 0, 255)},
+		{1, 1, RGBColor(255, 0, 0), RGBColor(127, 0, 0)},
+		{2, 1, RGBColor(0, 100, 0), RGBColor(0, 100, 0)},
+	}
+	for _, tt := range tests {
+		c := term.buffer.Cells[tt.y][tt.x]
+		if c.Ch != '▀' || c.Fg != tt.fg || c.Bg != tt.bg {
+			t.Errorf("cell %d,%d = %q fg %#x bg %#x, want ▀ fg %#x bg %#x", tt.x, tt.y, c.Ch, c.Fg, c.Bg, tt.fg, tt.bg)
+		}
+	}
+	if c := term.buffer.Cells[0][0]; c.Ch != ' ' {
+		t.Errorf("cell 0,0 = %q, want it untouched", c.Ch)
+	}
+}
+
+func TestSchedulerCoalesces(t *testing.T) {
+	resetTerm(t, 4, 1)
+	discardOutput(t)
+	draws := 0
+	s := NewScheduler(20*time.Millisecond, func() { draws++ })
+	defer s.Stop()
+
+	for i := 0; i < 50; i++ {
+		s.RequestRedraw()
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.Update(func() {
+		if draws != 1 {
+			t.Errorf("50 requests in one interval drew %d times, want 1", draws)
+		}
+	})
+
+	s.RequestRedraw()
+	time.Sleep(100 * time.Millisecond)
+	s.Update(func() {
+		if draws != 2 {
+			t.Errorf("a later request made %d draws in all, want 2", draws)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAttributeSettersIndependent(t *testing.T) {
+	resetTerm(t, 2, 1)
+	Italic(true)
+	Underline(true)
+	Bold(true)
+	s := CurrentStyle()
+	if !s.Bold || !s.Italic || !s.Under {
+		t.Errorf("after Italic, Underline, Bold style = %+v, want all three set", s)
+	}
+	Bold(false)
+	if s := CurrentStyle(); s.Bold || !s.Italic || !s.Under {
+		t.Errorf("Bold(false) changed other attributes: %+v", s)
+	}
+	SetCell(0, 0, 'x', 7, 0)
+	if c := term.buffer.Cells[0][0]; c.Bold || !c.Italic || !c.Under {
+		t.Errorf("cell = %+v, want italic underlined and not bold", c)
+	}
+}
+
+func TestAltScreenActive(t *testing.T) {
+	resetTerm(t, 4, 2)
+	if AltScreenActive() {
+		t.Error("AltScreenActive before Init")
+	}
+	term.initialized, term.altScreen, term.startKnown = true, true, true
+	discardOutput(t)
+
+	steps := []struct {
+		name string
+		fn   func()
+		want bool
+	}{
+		{"leave", LeaveAltScreen, false},
+		{"leave again", LeaveAltScreen, false},
+		{"enter", EnterAltScreen, true},
+		{"enter again", EnterAltScreen, true},
+		{"leave", LeaveAltScreen, false},
+	}
+	for _, st := range steps {
+		st.fn()
+		if got := AltScreenActive(); got != st.want {
+			t.Errorf("after %s AltScreenActive = %v, want %v", st.name, got, st.want)
+		}
+	}
+
+	out := string(captureOutput(t, LeaveAltScreen))
+	if out != "" {
+		t.Errorf("leaving twice wrote %q", out)
+	}
+}
+
+func TestFillRectMatchesFill(t *testing.T) {
+	rects := []Rect{{1, 1, 3, 2}, {0, 0, 6, 4}, {4, 2, 5, 5}, {-1, -1, 3, 3}, {2, 2, 0, 3}}
+	for _, r := range rects {
+		resetTerm(t, 6, 4)
+		Fill(r.X, r.Y, r.W, r.H, '#')
+		want := make([]string, 4)
+		for y := range want {
+			want[y] = rowText(y)
+		}
+		resetTerm(t, 6, 4)
+		FillRect(r, '#')
+		for y := range want {
+			if got := rowText(y); got != want[y] {
+				t.Errorf("FillRect(%+v) row %d = %q, Fill gave %q", r, y, got, want[y])
+			}
+		}
+	}
+}
+
+func TestLocalMouse(t *testing.T) {
+	resetTerm(t, 20, 10)
+	evt := Event{Type: EventMouse, X: 7, Y: 5}
+	PushOffset(2, 1)
+	PushClip(0, 0, 10, 5)
+	PushOffset(3, 2)
+	x, y, inside := LocalMouse(evt)
+	if x != 2 || y != 2 || !inside {
+		t.Errorf("nested LocalMouse = %d, %d, %v; want 2, 2, true", x, y, inside)
+	}
+	if _, _, inside := LocalMouse(Event{Type: EventMouse, X: 12, Y: 5}); inside {
+		t.Error("event right of the clip reported inside")
+	}
+	PopOffset()
+	PopClip()
+	if x, y, _ := LocalMouse(evt); x != 5 || y != 4 {
+		t.Errorf("after one PopOffset LocalMouse = %d, %d; want 5, 4", x, y)
+	}
+	PopOffset()
+	if x, y, inside := LocalMouse(evt); x != 7 || y != 5 || !inside {
+		t.Errorf("with no offset LocalMouse = %d, %d, %v; want 7, 5, true", x, y, inside)
+	}
+}
+
+func TestPromptBackspaceWide(t *testing.T) {
+	resetTerm(t, 10, 1)
+	p := Prompt{Label: ">"}
+	p.SetValue("a日本")
+	p.Draw(0, 0, 10)
+	if row := term.buffer.Cells[0]; row[2].Ch != '日' || !row[3].Cont || row[4].Ch != '本' || !row[5].Cont {
+		t.Fatalf("row = %q, want 日 and 本 two columns each", rowText(0))
+	}
+	if x, _ := CursorPos(); x != 6 {
+		t.Errorf("cursor at %d, want 6 after two wide characters", x)
+	}
+
+	p.Feed(Event{Type: EventKey, Key: KeyBackspace})
+	if p.Value() != "a日" {
+		t.Errorf("value after Backspace = %q, want %q", p.Value(), "a日")
+	}
+	p.Draw(0, 0, 10)
+	row := term.buffer.Cells[0]
+	if row[2].Ch != '日' || !row[3].Cont || row[4].Ch != ' ' || row[4].Cont || row[5].Ch != ' ' || row[5].Cont {
+		t.Errorf("row after Backspace = %q, want both columns of 本 cleared", rowText(0))
+	}
+	if x, _ := CursorPos(); x != 4 {
+		t.Errorf("cursor at %d after Backspace, want 4", x)
+	}
+
+	p.Feed(Event{Type: EventKey, Key: KeyArrowLeft})
+	if x := CursorColumn(p.text, p.pos); x != 1 {
+		t.Errorf("ArrowLeft over 日 landed at column %d, want 1", x)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	const pasted = 4000
+	reads := func(size int) int {
+		resetTerm(t, 10, 1)
+		in := pipeInput(t)
+		SetReadBufferSize(size)
+		var rec bytes.Buffer
+		RecordInput(&rec)
+		in.WriteString(strings.Repeat("x", pasted))
+		for i := 0; i < pasted; i++ {
+			if evt, err := PollEvent(); err != nil || evt.Ch != 'x' {
+				t.Fatalf("event %d = %+v, %v", i, evt, err)
+			}
+		}
+		return strings.Count(rec.String(), "\n")
+	}
+
+	small, large := reads(10), reads(8192)
+	if small != (pasted+minReadBufferSize-1)/minReadBufferSize {
+		t.Errorf("%d bytes took %d reads with the minimum buffer", pasted, small)
+	}
+	if large != 1 {
+		t.Errorf("%d bytes took %d reads with an 8K buffer, want 1", pasted, large)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	resetTerm(t, 20, 2)
+	discardOutput(t)
+	PrintAt(0, 1, "keep")
+	SetCursor(0, 1)
+
+	replay := func(keys string) {
+		t.Helper()
+		if err := ReplayInput(strings.NewReader("0 "+strconv.Quote(keys)+"\n"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replay("abx\x7fc\r")
+	line, err := ReadLine("> ")
+	if err != nil || line != "abc" {
+		t.Errorf("ReadLine = %q, %v; want \"abc\"", line, err)
+	}
+	if got := rowText(1)[:6]; got != "keep  " {
+		t.Errorf("row after ReadLine = %q, want it put back", got)
+	}
+
+	replay("ab\x1b")
+	if line, err := ReadLine("> "); !errors.Is(err, ErrCanceled) || line != "" {
+		t.Errorf("ReadLine with Escape = %q, %v; want ErrCanceled", line, err)
+	}
+}
+
+func TestPalette256RGB(t *testing.T) {
+	tests := []struct {
+		index   int
+		r, g, b int
+	}{
+		{16, 0, 0, 0},
+		{196, 255, 0, 0},
+		{231, 255, 255, 255},
+		{232, 8, 8, 8},
+		{244, 128, 128, 128},
+		{255, 238, 238, 238},
+	}
+	for _, tt := range tests {
+		if r, g, b := Palette256RGB(tt.index); r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("Palette256RGB(%d) = %d,%d,%d, want %d,%d,%d", tt.index, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+}
+
+func TestPresentCursor(t *testing.T) {
+	resetTerm(t, 3, 1)
+	Present()
+	term.cursorVisible = true
+	SetCursor(2, 0)
+	SetCell(0, 0, 'a', 7, 0)
+
+	got := string(capturePresent(t))
+	want := HideCursor + "\x1b[1;1H\x1b[38;5;7m\x1b[48;5;0ma" + ResetColor + "\x1b[1;3H" + ShowCursor
+	if got != want {
+		t.Errorf("Present wrote %q, want %q", got, want)
+	}
+}
+
+func TestPrintAtCombiningMark(t *testing.T) {
+	resetTerm(t, 4, 1)
+	Present()
+	PrintAt(0, 0, "e\u0301x")
+	row := term.buffer.Cells[0]
+	if row[0].Ch != 'e' || row[0].Seq != "e\u0301" || row[1].Ch != 'x' {
+		t.Fatalf("cells = %q/%q, %q; want the accent on the first cell and x next", row[0].Ch, row[0].Seq, row[1].Ch)
+	}
+	if got := string(capturePresent(t)); !strings.Contains(got, "e\u0301x") {
+		t.Errorf("Present wrote %q, want the base and its mark before x", got)
+	}
+}
+
+func TestPushColorNested(t *testing.T) {
+	resetTerm(t, 4, 1)
+	SetColor(7, 0)
+	PushColor(1, 2)
+	PushAttr(true, false, false, false, false)
+	PushColor(3, 4)
+	SetColor(5, 6)
+	PopColor()
+	if s := CurrentStyle(); s.Fg != 1 || s.Bg != 2 || !s.Bold {
+		t.Errorf("after inner PopColor style = %+v, want 1/2 bold", s)
+	}
+	PopAttr()
+	PopColor()
+	if s := CurrentStyle(); s.Fg != 7 || s.Bg != 0 || s.Bold {
+		t.Errorf("after all pops style = %+v, want 7/0 plain", s)
+	}
+	PopColor()
+	if s := CurrentStyle(); s.Fg != 7 || s.Bg != 0 {
+		t.Errorf("unmatched PopColor changed style to %+v", s)
+	}
+}
+
+func TestDrawTextIn(t *testing.T) {
+	resetTerm(t, 12, 4)
+	DrawTextRightIn(2, 0, 6, "ab", 7, 0)
+	DrawTextCenterIn(2, 1, 6, "ab", 7, 0)
+	DrawTextRightIn(2, 2, 6, "世界", 7, 0)
+	DrawTextRightIn(2, 3, 4, "abcdef", 7, 0)
+	tests := []struct {
+		y    int
+		want string
+	}{
+		{0, "      ab    "},
+		{1, "    ab      "},
+		{3, "  cdef      "},
+	}
+	for _, tt := range tests {
+		if got := rowText(tt.y); got != tt.want {
+			t.Errorf("row %d = %q, want %q", tt.y, got, tt.want)
+		}
+	}
+	if c := term.buffer.Cells[2][4]; c.Ch != '世' {
+		t.Errorf("wide text starts with %q at column 4, want 世", c.Ch)
+	}
+}
+
+func TestParseOSCColorReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		r, g, b int
+		ok      bool
+	}{
+		{"\x1b]11;rgb:1e1e/1e1e/2e2e\x07", 30, 30, 46, true},
+		{"\x1b]11;rgb:ffff/ffff/ffff\x1b\\", 255, 255, 255, true},
+		{"\x1b]11;rgb:f/8/0\x07", 255, 136, 0, true},
+		{"\x1b]11;rgb:1e1e/1e1e\x07", 0, 0, 0, false},
+		{"\x1b]11;?\x07", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		spec, ok := parseOSCColorReply([]byte(tt.reply))
+		var r, g, b int
+		if ok {
+			r, g, b, ok = parseRGBSpec(spec)
+		}
+		if ok != tt.ok || r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("reply %q = %d,%d,%d %v; want %d,%d,%d %v", tt.reply, r, g, b, ok, tt.r, tt.g, tt.b, tt.ok)
+		}
+	}
+}
+
+func TestStrictBounds(t *testing.T) {
+	resetTerm(t, 4, 2)
+	var log bytes.Buffer
+	SetDebugWriter(&log)
+	PrintAt(2, 5, "x")
+	if log.Len() != 0 {
+		t.Errorf("draw outside the screen logged %q with strict bounds off", log.String())
+	}
+
+	SetStrictBounds(true)
+	PrintAt(2, 0, "abc")
+	if got := log.String(); !strings.Contains(got, "draw at 4,0 outside 4x2 screen") {
+		t.Errorf("debug log = %q, want the out-of-bounds draw at 4,0", got)
+	}
+	log.Reset()
+	PrintAt(0, 1, "ok")
+	if log.Len() != 0 {
+		t.Errorf("draw inside the screen logged %q", log.String())
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	resetTerm(t, 10, 2)
+	SetEventFilter(func(evt Event) (Event, bool) {
+		switch evt.Ch {
+		case 'q':
+			return evt, false
+		case 'a':
+			evt.Ch = 'A'
+		}
+		return evt, true
+	})
+	// One read, so all but the first come off the queue.
+	pipeInput(t).WriteString("qabq")
+	for _, want := range []rune{'A', 'b'} {
+		if evt, err := PollEvent(); err != nil || evt.Ch != want {
+			t.Errorf("PollEvent = %q, %v; want %q", evt.Ch, err, want)
+		}
+	}
+	if evt, ok := PollEventNow(); ok {
+		t.Errorf("PollEventNow = %+v, want the dropped q gone", evt)
+	}
+}
+
+func TestMinimumSize(t *testing.T) {
+	resetTerm(t, 40, 3)
+	term.eventQueue = make([]Event, 0, 8)
+	SetMinimumSize(20, 5)
+	PrintAt(0, 0, "app")
+
+	out := string(capturePresent(t))
+	if !strings.Contains(out, "terminal too small (need 20x5)") || strings.Contains(out, "app") {
+		t.Errorf("Present below the minimum wrote %q, want only the notice", out)
+	}
+	scratch := &term.tooSmallBuf.Cells[0][0]
+	if out := string(capturePresent(t)); strings.Contains(out, "terminal") {
+		t.Errorf("second Present wrote %q, want the notice left alone", out)
+	}
+	if &term.tooSmallBuf.Cells[0][0] != scratch {
+		t.Error("notice buffer reallocated for a frame of the same size")
+	}
+
+	SetSize(40, 5)
+	if out := string(capturePresent(t)); !strings.Contains(out, "app") {
+		t.Errorf("Present at the minimum wrote %q, want the app's content", out)
+	}
+	SetSize(40, 3)
+	capturePresent(t)
+	if got := string(term.backBuffer.Cells[0][0].Ch); got != " " {
+		t.Errorf("screen kept %q from the app under the notice", got)
+	}
+	if got := rowText(0); got[:3] != "app" {
+		t.Errorf("app row = %q, want it kept for when the screen grows", got)
+	}
+}
+
+func TestPromptFeed(t *testing.T) {
+	key := func(k Key) Event { return Event{Type: EventKey, Key: k} }
+	ch := func(r rune) Event { return Event{Type: EventKey, Ch: r} }
+	events := []Event{
+		ch('b'), ch('x'), key(KeyBackspace), ch('c'),
+		key(KeyHome), ch('a'),
+		{Type: EventMouse, X: 1, Y: 1},
+		key(KeyEnd), {Type: EventPaste, Text: " d\ne"},
+	}
+	p := Prompt{Label: "> "}
+	for i, evt := range events {
+		if r := p.Feed(evt); r.State != PromptPending {
+			t.Fatalf("event %d ended the prompt with %+v", i+1, r)
+		}
+	}
+	if r := p.Feed(key(KeyEnter)); r.State != PromptConfirmed || r.Value != "abc d e" {
+		t.Errorf("Enter = %+v, want confirmed with \"abc d e\"", r)
+	}
+
+	p = Prompt{}
+	p.Feed(ch('a'))
+	if r := p.Feed(key(KeyEscape)); r.State != PromptCancelled || r.Value != "" {
+		t.Errorf("Escape = %+v, want cancelled", r)
+	}
+}
+
+func TestSelectionMultiRow(t *testing.T) {
+	resetTerm(t, 5, 3)
+	for y := 0; y < 3; y++ {
+		PrintAt(0, y, "abcde")
+	}
+	capturePresent(t)
+	SetSelection(1, 2, 3, 0) // ends in either order
+	capturePresent(t)
+	want := []string{"...##", "#####", "##..."}
+	for y, row := range want {
+		for x, mark := range row {
+			if got := term.backBuffer.Cells[y][x].Rev; got != (mark == '#') {
+				t.Errorf("cell %d,%d reversed = %v, want %v", x, y, got, mark == '#')
+			}
+			if term.buffer.Cells[y][x].Rev {
+				t.Errorf("cell %d,%d reversed in the app's buffer", x, y)
+			}
+		}
+	}
+
+	ClearSelection()
+	capturePresent(t)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			if term.backBuffer.Cells[y][x].Rev {
+				t.Errorf("cell %d,%d still reversed after ClearSelection", x, y)
+			}
+		}
+	}
+}
+
+func TestPresentRepeat(t *testing.T) {
+	resetTerm(t, 10, 1)
+	term.repOutput = true
+	for x := 0; x < 9; x++ {
+		SetCell(x, 0, '=', 7, 0)
+	}
+	SetCell(9, 0, '>', 7, 0)
+
+	got := string(capturePresent(t))
+	want := "\x1b[1;1H\x1b[38;5;7m\x1b[48;5;0m=\x1b[8b>" + ResetColor
+	if got != want {
+		t.Errorf("Present wrote %q, want %q", got, want)
+	}
+
+	term.repOutput = false
+	for x := 0; x < 9; x++ {
+		SetCell(x, 0, '-', 7, 0)
+	}
+	if got := string(capturePresent(t)); bytes.Contains([]byte(got), []byte("b")) {
+		t.Errorf("Present used REP while disabled: %q", got)
+	}
+}
+
+// BenchmarkPresentRule redraws a full-width rule line with and without REP,
+// reporting the bytes each frame sends.
+func BenchmarkPresentRule(b *testing.B) {
+	for _, rep := range []bool{false, true} {
+		b.Run("rep="+strconv.FormatBool(rep), func(b *testing.B) {
+			term = Terminal{width: 200, height: 60}
+			term.buffer = initBuffer(term.width, term.height)
+			term.backBuffer = initBuffer(term.width, term.height)
+			term.repOutput = rep
+			b.Cleanup(func() { term = Terminal{} })
+			discardOutput(b)
+			rules := []rune{'-', '='}
+			frame := func(i int) {
+				SetColor(7, 0)
+				FillRun(0, 30, term.width, rules[i%2])
+				Present()
+			}
+			frame(0)
+			n := len(captureOutput(b, func() { frame(1) }))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				frame(i)
+			}
+			b.ReportMetric(float64(n), "bytes/frame")
+		})
+	}
+}
+
+func TestTimerPollEvent(t *testing.T) {
+	resetTerm(t, 10, 2)
+	in := pipeInput(t)
+	start := time.Now()
+	fast, slow := AddTimer(20*time.Millisecond), AddTimer(70*time.Millisecond)
+
+	evt, err := PollEvent()
+	if err != nil || evt.Type != EventTimer || evt.Timer != fast {
+		t.Fatalf("PollEvent = %+v, %v; want EventTimer %d", evt, err, fast)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("timer fired after %v, want at least its 20ms interval", elapsed)
+	}
+	ticks := 1
+	for {
+		evt, err := PollEvent()
+		if err != nil || evt.Type != EventTimer {
+			t.Fatalf("PollEvent = %+v, %v; want EventTimer", evt, err)
+		}
+		if evt.Timer == slow {
+			break
+		}
+		ticks++
+	}
+	if ticks < 2 {
+		t.Errorf("fast timer ticked %d times before the slow one, want at least 2", ticks)
+	}
+
+	RemoveTimer(fast)
+	RemoveTimer(slow)
+	in.WriteString("k")
+	if evt, err := PollEvent(); err != nil || evt.Type != EventKey || evt.Ch != 'k' {
+		t.Errorf("PollEvent after RemoveTimer = %+v, %v; want the key", evt, err)
+	}
+}
+
+// BenchmarkRenderMode presents a screen that changes everywhere every frame
+// in each render mode.
+func BenchmarkRenderMode(b *testing.B) {
+	modes := []struct {
+		name string
+		mode RenderMode
+	}{
+		{"incremental", RenderIncremental},
+		{"full", RenderFull},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			term = Terminal{width: 200, height: 60}
+			term.buffer = initBuffer(term.width, term.height)
+			term.backBuffer = initBuffer(term.width, term.height)
+			b.Cleanup(func() { term = Terminal{} })
+			discardOutput(b)
+			SetRenderMode(m.mode)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				drawFrame(i)
+				Present()
+			}
+		})
+	}
+}
+
+func TestDrawTextTransposed(t *testing.T) {
+	resetTerm(t, 4, 4)
+	DrawTextTransposed(1, 0, "cpu\nmemory", 7, 0)
+	want := []string{" cm ", " pe ", " um ", "  o "}
+	for y, w := range want {
+		if got := rowText(y); got != w {
+			t.Errorf("row %d = %q, want %q", y, got, w)
+		}
+	}
+	if c := term.buffer.Cells[0][1]; c.Fg != 7 || c.Bg != 0 {
+		t.Errorf("cell colors = %d/%d, want 7/0", c.Fg, c.Bg)
+	}
+}
+
+func TestSetScrollRegion(t *testing.T) {
+	resetTerm(t, 10, 5)
+	tests := []struct {
+		name string
+		set  func()
+		want string
+	}{
+		{"band", func() { SetScrollRegion(1, 3) }, "\x1b[2;4r"},
+		{"clamped", func() { SetScrollRegion(-2, 99) }, "\x1b[1;5r"},
+		{"empty", func() { SetScrollRegion(3, 3) }, ResetScrollMargins},
+		{"reset", ResetScrollRegion, ResetScrollMargins},
+	}
+	for _, tt := range tests {
+		if got := string(captureOutput(t, tt.set)); got != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if term.scrollRegion {
+		t.Error("scroll region still recorded after ResetScrollRegion")
+	}
+}
+
+func TestRampRGB(t *testing.T) {
+	tests := []struct {
+		ramp    Ramp
+		t       float64
+		r, g, b int
+	}{
+		{RampHeat, 0, 0, 0, 255},
+		{RampHeat, 0.5, 128, 255, 0},
+		{RampHeat, 1, 255, 0, 0},
+		{RampHeat, -1, 0, 0, 255},
+		{RampHeat, 2, 255, 0, 0},
+		{RampGray, 0.5, 128, 128, 128},
+		{RampViridis, 0, 68, 1, 84},
+		{RampViridis, 0.5, 33, 145, 140},
+		{RampViridis, 1, 253, 231, 37},
+		{RampJet, 1, 128, 0, 0},
+	}
+	for _, tt := range tests {
+		if r, g, b := RampRGB(tt.ramp, tt.t); r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("RampRGB(%d, %v) = %d,%d,%d, want %d,%d,%d", tt.ramp, tt.t, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+	if c := HeatmapColor(0); c != 21 {
+		t.Errorf("HeatmapColor(0) = %d, want 21 (blue)", c)
+	}
+	if c := HeatmapColor(1); c != 196 {
+		t.Errorf("HeatmapColor(1) = %d, want 196 (red)", c)
+	}
+}
+
+func TestCopyToClipboardTmux(t *testing.T) {
+	resetTerm(t, 10, 2)
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1234,0")
+	got := string(captureOutput(t, func() { CopyToClipboard("hi") }))
+	want := "\x1bPtmux;\x1b\x1b]52;c;aGk=\a\x1b\\"
+	if got != want {
+		t.Errorf("CopyToClipboard in tmux wrote %q, want %q", got, want)
+	}
+
+	SetMux(MuxNone)
+	if got := string(captureOutput(t, func() { CopyToClipboard("hi") })); got != "\x1b]52;c;aGk=\a" {
+		t.Errorf("CopyToClipboard with the override wrote %q, want bare OSC 52", got)
+	}
+}
+
+func TestCellEqual(t *testing.T) {
+	base := Cell{Ch: 'a', Fg: 7, Bg: 0, UnderColor: -1}
+	dirty := base
+	dirty.Dirty = true
+	if !base.Equal(dirty) {
+		t.Error("cells differing only in Dirty are not Equal")
+	}
+	tests := []struct {
+		name   string
+		change func(*Cell)
+	}{
+		{"Seq", func(c *Cell) { c.Seq = "a\u0301" }},
+		{"UnderColor", func(c *Cell) { c.UnderColor = 1 }},
+		{"Strike", func(c *Cell) { c.Strike = true }},
+		{"UnderStyle", func(c *Cell) { c.UnderStyle = UnderlineCurly }},
+		{"Cont", func(c *Cell) { c.Cont = true }},
+	}
+	for _, tt := range tests {
+		other := base
+		tt.change(&other)
+		if base.Equal(other) {
+			t.Errorf("cells differing in %s are Equal", tt.name)
+		}
+	}
+}
+
+func TestBoxTitled(t *testing.T) {
+	tests := []struct {
+		w     int
+		title string
+		align Align
+		want  string
+	}{
+		{20, "Title", AlignLeft, "┌─ Title ──────────┐"},
+		{20, "Title", AlignCenter, "┌───── Title ──────┐"},
+		{20, "Title", AlignRight, "┌────────── Title ─┐"},
+		{10, "Dashboard", AlignLeft, "┌─ Das… ─┐"},
+		{10, "Load", AlignLeft, "┌─ Load ─┐"},
+		{6, "Load", AlignLeft, "┌────┐"},
+	}
+	for _, tt := range tests {
+		resetTerm(t, tt.w, 3)
+		BoxTitledAlign(0, 0, tt.w, 3, tt.title, tt.align)
+		if got := rowText(0); got != tt.want {
+			t.Errorf("%d wide, %q: top border = %q, want %q", tt.w, tt.title, got, tt.want)
+		}
+	}
+	if s, w := ellipsize("世界世界", 4); s != "世…" || w != 3 {
+		t.Errorf("ellipsize of wide text = %q, %d; want \"世…\", 3", s, w)
+	}
+}